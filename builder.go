@@ -0,0 +1,160 @@
+package mealy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// Returned when building would take the registry of unique states past the
+// memory ceiling given in BuildOptions.
+var ErrRegistryFull = errors.New("registry of unique states exceeds memory ceiling")
+
+// Options for building a machine.
+type BuildOptions struct {
+	// Maximum estimated memory, in bytes, that the registry of unique states
+	// (which includes the states of the machine under construction) may use.
+	// Zero means no limit.
+	MaxRegistryBytes int64
+}
+
+// Statistics about a build in progress, or a finished one.
+type BuildStats struct {
+	// Number of values added.
+	Values int
+	// Number of unique states created.
+	States int
+	// Largest estimated memory used by the registry of unique states, in
+	// bytes, including the states it holds.
+	PeakRegistryBytes int64
+}
+
+// Incrementally builds a minimal machine from values added in increasing
+// order.
+//
+// States are created from the bottom up: the states for the end of the
+// previous value are only completed (and registered, merging them with any
+// equivalent states) once a new value shows that they can no longer change.
+// Until then, they are kept as "larvae", one per position in the previous
+// value.
+type Builder struct {
+	opts      BuildOptions
+	reg       *registry
+	terminals []bool
+	larvae    []state
+	prevValue []byte
+	values    int
+	err       error
+	// Set once the registry has been released by FinishFlat.
+	finalStats *BuildStats
+}
+
+func NewBuilder(opts BuildOptions) *Builder {
+	return &Builder{
+		opts:      opts,
+		reg:       newRegistry(),
+		terminals: []bool{false},
+		larvae:    []state{{}},
+		prevValue: []byte{},
+	}
+}
+
+// Find the longest common prefix length.
+func commonPrefixLen(a, b []byte) (l int) {
+	for l = 0; l < len(a) && l < len(b) && a[l] == b[l]; l++ {
+	}
+	return
+}
+
+// Make all states up to but not including the prefix point.
+// Modifies larvae by adding transitions as needed.
+func (b *Builder) makeSuffixStates(p int) {
+	for i := len(b.prevValue); i > p; i-- {
+		b.larvae[i-1].AddTransition(
+			NewTransition(b.prevValue[i-1],
+				b.reg.Register(b.larvae[i]),
+				b.terminals[i]))
+	}
+}
+
+// Add the next value, which must be strictly greater than the last. Returns
+// ErrTooManyStates if the machine needs more states than transitions can refer
+// to, or ErrRegistryFull if the memory ceiling is exceeded. Once an error is
+// returned, the same error is returned for every later call, and the build
+// cannot be finished.
+func (b *Builder) Add(value []byte) error {
+	if b.err != nil {
+		return b.err
+	}
+	if bytes.Compare(b.prevValue, value) >= 0 {
+		b.err = fmt.Errorf(
+			"cannot build a Mealy machine from out-of-order "+
+				"values: %v : %v",
+			b.prevValue, value)
+		return b.err
+	}
+	prefixLen := commonPrefixLen(b.prevValue, value)
+	b.makeSuffixStates(prefixLen)
+	// Go from first uncommon byte to end of new value, resetting
+	// everything (creating new states as needed).
+	b.larvae = b.larvae[:prefixLen+1]
+	b.terminals = b.terminals[:prefixLen+1]
+	for i := prefixLen + 1; i < len(value)+1; i++ {
+		b.larvae = append(b.larvae, state{})
+		b.terminals = append(b.terminals, false)
+	}
+	b.terminals[len(value)] = true
+	b.prevValue = value
+	b.values++
+	return b.checkRegistry()
+}
+
+func (b *Builder) checkRegistry() error {
+	if b.reg.overflowed() {
+		b.err = ErrTooManyStates
+	} else if b.opts.MaxRegistryBytes > 0 && b.reg.peakBytes > b.opts.MaxRegistryBytes {
+		b.err = ErrRegistryFull
+	}
+	return b.err
+}
+
+// Return statistics about the build so far.
+func (b *Builder) Stats() BuildStats {
+	if b.finalStats != nil {
+		return *b.finalStats
+	}
+	return BuildStats{
+		Values:            b.values,
+		States:            len(b.reg.states),
+		PeakRegistryBytes: b.reg.peakBytes,
+	}
+}
+
+// Make all remaining states except the start state, which is returned
+// unregistered.
+func (b *Builder) finishSuffixes() state {
+	b.makeSuffixStates(0)
+	return b.larvae[0]
+}
+
+// Finish up by making all remaining states, then create a start state and
+// return the finished machine. Returns the first error encountered by Add, if
+// any, or ErrTooManyStates or ErrRegistryFull if finishing exceeds the limits
+// that Add checks.
+func (b *Builder) Finish() (Recognizer, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	if startId := b.reg.Register(b.finishSuffixes()); startId != len(b.reg.states)-1 {
+		panic(fmt.Sprintf(
+			"Unexpected start ID, not at the end: %v < %v",
+			startId, len(b.reg.states)-1))
+	}
+
+	if err := b.checkRegistry(); err != nil {
+		return nil, err
+	}
+
+	// Start state is at len - 1; final state is at 0.
+	return b.reg.states, nil
+}
@@ -1,5 +1,9 @@
 package mealy
 
+import (
+	"bytes"
+)
+
 // Implement this to specify constraints for the Mealy machine output.
 //
 // To specify a minimum and/or maximum length, implement IsLargeEnough and/or
@@ -53,3 +57,36 @@ func (c BaseConstraints) IsValueAllowed(int, byte) bool {
 func (c BaseConstraints) IsSequenceAllowed([]byte) bool {
 	return true
 }
+
+// Constraints that allow only sequences of exactly len(c) values, where the
+// value at position i is one of the values listed in c[i].
+type PositionalConstraints [][]byte
+
+func (c PositionalConstraints) IsSmallEnough(size int) bool {
+	return size <= len(c)
+}
+func (c PositionalConstraints) IsLargeEnough(size int) bool {
+	return size >= len(c)
+}
+func (c PositionalConstraints) IsValueAllowed(pos int, val byte) bool {
+	return pos < len(c) && bytes.IndexByte(c[pos], val) >= 0
+}
+func (c PositionalConstraints) IsSequenceAllowed([]byte) bool {
+	return true
+}
+
+// Constraints that allow only sequences beginning with the given prefix.
+type PrefixConstraints []byte
+
+func (c PrefixConstraints) IsSmallEnough(int) bool {
+	return true
+}
+func (c PrefixConstraints) IsLargeEnough(size int) bool {
+	return size >= len(c)
+}
+func (c PrefixConstraints) IsValueAllowed(pos int, val byte) bool {
+	return pos >= len(c) || c[pos] == val
+}
+func (c PrefixConstraints) IsSequenceAllowed([]byte) bool {
+	return true
+}
@@ -0,0 +1,177 @@
+package mealy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Options for WriteDOT.
+type DOTOptions struct {
+	// Name of the graph. If empty, "mealy" is used.
+	Name string
+	// Render only the first MaxStates states reached breadth-first from the
+	// start state, or all of them if zero.
+	MaxStates int
+	// Lay the graph out left to right instead of top to bottom.
+	LeftToRight bool
+}
+
+// Return a readable label for a trigger value.
+func triggerLabel(b byte) string {
+	if b > ' ' && b < 0x7f {
+		return string(b)
+	}
+	return fmt.Sprintf("0x%02x", b)
+}
+
+// Write the machine as a Graphviz DOT graph. States are labeled with their
+// IDs, the start state is drawn with a double circle, and terminal transitions
+// are drawn bold and red.
+func (self Recognizer) WriteDOT(w io.Writer, opts DOTOptions) error {
+	bw := bufio.NewWriter(w)
+	name := opts.Name
+	if name == "" {
+		name = "mealy"
+	}
+	fmt.Fprintf(bw, "digraph %s {\n", strconv.Quote(name))
+	if opts.LeftToRight {
+		fmt.Fprintln(bw, "\trankdir=LR;")
+	}
+	fmt.Fprintln(bw, "\tnode [shape=circle];")
+
+	order := BreadthFirst().order(self)
+	if opts.MaxStates > 0 && len(order) > opts.MaxStates {
+		order = order[:opts.MaxStates]
+	}
+	shown := make(map[int]bool, len(order))
+	for _, id := range order {
+		shown[id] = true
+	}
+
+	for _, id := range order {
+		shape := ""
+		if id == self.StartId() {
+			shape = ", shape=doublecircle"
+		}
+		fmt.Fprintf(bw, "\t%d [label=\"%d\"%s];\n", id, id, shape)
+	}
+	for _, id := range order {
+		for _, t := range self[id] {
+			if !shown[t.ToState()] {
+				continue
+			}
+			style := ""
+			if t.IsTerminal() {
+				style = ", color=red, fontcolor=red, style=bold"
+			}
+			fmt.Fprintf(bw, "\t%d -> %d [label=%s%s];\n",
+				id, t.ToState(), strconv.Quote(triggerLabel(t.Trigger())), style)
+		}
+	}
+	fmt.Fprintln(bw, "}")
+	return bw.Flush()
+}
+
+// The JSON form of a transition.
+type jsonTransition struct {
+	Trigger  byte `json:"trigger"`
+	To       int  `json:"to"`
+	Terminal bool `json:"terminal,omitempty"`
+}
+
+// The JSON form of a machine: its start state ID and the transitions of every
+// state, indexed by state ID.
+type jsonMachine struct {
+	Start  int                `json:"start"`
+	States [][]jsonTransition `json:"states"`
+}
+
+// Write the state table as JSON, which can be read back with ReadJSON.
+func (self Recognizer) WriteJSON(w io.Writer) error {
+	jm := jsonMachine{
+		Start:  self.StartId(),
+		States: make([][]jsonTransition, len(self)),
+	}
+	for id, s := range self {
+		jm.States[id] = make([]jsonTransition, len(s))
+		for i, t := range s {
+			jm.States[id][i] = jsonTransition{t.Trigger(), t.ToState(), t.IsTerminal()}
+		}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(jm)
+}
+
+// Read a state table written by WriteJSON. The start state must be the last
+// one, every transition must lead to an existing state, and there must be no
+// cycles.
+func ReadJSON(r io.Reader) (Recognizer, error) {
+	var jm jsonMachine
+	if err := json.NewDecoder(r).Decode(&jm); err != nil {
+		return nil, err
+	}
+	if jm.Start != len(jm.States)-1 {
+		return nil, fmt.Errorf("start state %d is not the last state", jm.Start)
+	}
+	m := make(Recognizer, len(jm.States))
+	for id, js := range jm.States {
+		m[id] = make(state, 0, len(js))
+		for _, jt := range js {
+			if jt.To < 0 || jt.To >= len(m) {
+				return nil, fmt.Errorf("state %d has a transition to missing state %d", id, jt.To)
+			}
+			if m[id].IndexForTrigger(jt.Trigger) < len(m[id]) {
+				return nil, fmt.Errorf("state %d has more than one transition for %d", id, jt.Trigger)
+			}
+			m[id].AddTransition(NewTransition(jt.Trigger, jt.To, jt.Terminal))
+		}
+	}
+	if id, ok := m.findCycle(); ok {
+		return nil, fmt.Errorf("state %d is on a cycle", id)
+	}
+	return m, nil
+}
+
+// Look for a state from which some path returns to itself. Every machine built
+// by this package is acyclic, and walking one that isn't would never end.
+//
+// Targets are not simply required to have lower IDs than their sources,
+// because Reorder does not preserve that.
+func (self Recognizer) findCycle() (int, bool) {
+	const (
+		unvisited = iota
+		active
+		done
+	)
+	color := make([]byte, len(self))
+	type frame struct{ id, next int }
+	for root := range self {
+		if color[root] != unvisited {
+			continue
+		}
+		stack := []frame{{root, 0}}
+		color[root] = active
+		for len(stack) > 0 {
+			top := &stack[len(stack)-1]
+			if top.next == len(self[top.id]) {
+				color[top.id] = done
+				stack = stack[:len(stack)-1]
+				continue
+			}
+			to := self[top.id][top.next].ToState()
+			top.next++
+			switch color[to] {
+			case active:
+				return to, true
+			case unvisited:
+				color[to] = active
+				stack = append(stack, frame{to, 0})
+			}
+		}
+	}
+	return 0, false
+}
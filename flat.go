@@ -0,0 +1,217 @@
+package mealy
+
+import "fmt"
+
+// A read-only machine stored in two flat slices, instead of one slice per
+// state: all transitions back to back, in state order, and the offset of each
+// state's first transition. This is far kinder to the garbage collector and
+// to the cache than a Recognizer when there are millions of states.
+//
+// It answers the same queries as a Recognizer. States with many transitions
+// also get a dense lookup table indexed by trigger value, so that stepping
+// through them does not require a binary search; see DenseFanout.
+type FlatRecognizer struct {
+	transitions []transition
+	// Transitions for state i are transitions[offsets[i]:offsets[i+1]].
+	offsets []uint32
+
+	// The index of each state's dense table, or -1 if it has none. Nil if no
+	// state has one.
+	dense []int32
+	// Dense tables of 256 entries each, back to back. Each entry is the index
+	// of the transition for that trigger within its state, plus one, or zero
+	// if there is no such transition.
+	tables []uint16
+}
+
+// States with at least this many transitions are given dense lookup tables
+// when a FlatRecognizer is created, built, or read. Each table costs 512 bytes,
+// and only pays off when a binary search over the state's transitions would
+// take several steps.
+const DenseFanout = 16
+
+// Create a flat copy of a machine.
+func NewFlatRecognizer(m Recognizer) FlatRecognizer {
+	f := FlatRecognizer{
+		transitions: make([]transition, 0, m.TotalTransitions()),
+		offsets:     make([]uint32, 1, len(m)+1),
+	}
+	for _, s := range m {
+		f.appendState(s)
+	}
+	return f.WithDenseFanout(DenseFanout)
+}
+
+// Return a machine sharing the same transitions, but with dense lookup tables
+// for exactly the states that have at least fanout transitions. A fanout of 0
+// or less removes all dense tables.
+func (f FlatRecognizer) WithDenseFanout(fanout int) FlatRecognizer {
+	f.dense, f.tables = nil, nil
+	if fanout <= 0 {
+		return f
+	}
+	for id := 0; id < f.numStates(); id++ {
+		s := f.stateAt(id)
+		if len(s) < fanout {
+			continue
+		}
+		if f.dense == nil {
+			f.dense = make([]int32, f.numStates())
+			for i := range f.dense {
+				f.dense[i] = -1
+			}
+		}
+		f.dense[id] = int32(len(f.tables) >> 8)
+		table := make([]uint16, 256)
+		for i, t := range s {
+			table[t.Trigger()] = uint16(i + 1)
+		}
+		f.tables = append(f.tables, table...)
+	}
+	return f
+}
+
+func (f *FlatRecognizer) appendState(s state) {
+	f.transitions = append(f.transitions, s...)
+	f.offsets = append(f.offsets, uint32(len(f.transitions)))
+}
+
+// Return an error if any transition refers to a state that does not exist, as
+// in a corrupt serialized machine.
+func (f FlatRecognizer) checkTargets() error {
+	n := f.numStates()
+	for id := 0; id < n; id++ {
+		for _, t := range f.transitions[f.offsets[id]:f.offsets[id+1]] {
+			if t.ToState() >= n {
+				return fmt.Errorf("state %d has a transition to missing state %d", id, t.ToState())
+			}
+		}
+	}
+	return nil
+}
+
+// Finish the build as with Finish, but return a flat machine.
+//
+// This is only a convenience: the builder's states are finished as usual and
+// then copied, so peak memory is that of both representations together, as
+// with calling Finish and copying the result yourself. The registry's hash
+// table is released before copying, and each state is released once copied,
+// so that the garbage collector can reclaim them; the savings come after,
+// from keeping only the flat machine.
+func (b *Builder) FinishFlat() (FlatRecognizer, error) {
+	m, err := b.Finish()
+	if err != nil {
+		return FlatRecognizer{}, err
+	}
+	stats := b.Stats()
+	b.finalStats = &stats
+	b.reg = newRegistry()
+	f := FlatRecognizer{
+		transitions: make([]transition, 0, m.TotalTransitions()),
+		offsets:     make([]uint32, 1, len(m)+1),
+	}
+	for i, s := range m {
+		f.appendState(s)
+		m[i] = nil
+	}
+	return f.WithDenseFanout(DenseFanout), nil
+}
+
+// Return a Recognizer with the same states. The states share memory with this
+// machine, so it is cheap, but neither should be modified.
+func (f FlatRecognizer) Recognizer() Recognizer {
+	m := make(Recognizer, f.numStates())
+	for i := range m {
+		m[i] = f.stateAt(i)
+	}
+	return m
+}
+
+func (f FlatRecognizer) numStates() int {
+	if len(f.offsets) == 0 {
+		return 0
+	}
+	return len(f.offsets) - 1
+}
+func (f FlatRecognizer) stateAt(id int) state {
+	start, end := f.offsets[id], f.offsets[id+1]
+	return f.transitions[start:end:end]
+}
+
+// Return the number of states.
+func (f FlatRecognizer) Len() int {
+	return f.numStates()
+}
+
+// Return the ID of the start state, suitable for passing to Step.
+func (f FlatRecognizer) StartId() int {
+	return f.numStates() - 1
+}
+
+// Follow a transition, exactly as Recognizer.Step does.
+func (f FlatRecognizer) Step(id int, value byte) (next int, terminal, ok bool) {
+	if id < 0 || id >= f.numStates() {
+		return
+	}
+	s := f.stateAt(id)
+	if f.dense != nil && f.dense[id] >= 0 {
+		if i := f.tables[int(f.dense[id])<<8|int(value)]; i > 0 {
+			return s[i-1].ToState(), s[i-1].IsTerminal(), true
+		}
+		return
+	}
+	if i := s.IndexForTrigger(value); i < len(s) {
+		return s[i].ToState(), s[i].IsTerminal(), true
+	}
+	return
+}
+
+func (f FlatRecognizer) Recognizes(value []byte) bool {
+	id, terminal := f.StartId(), false
+	for _, v := range value {
+		var ok bool
+		if id, terminal, ok = f.Step(id, v); !ok {
+			return false
+		}
+	}
+	return terminal
+}
+
+// Return a channel of all recognized sequences meeting the given constraints,
+// as with Recognizer.ConstrainedSequences.
+func (f FlatRecognizer) ConstrainedSequences(con Constraints) <-chan []byte {
+	return constrainedSequences(f, con)
+}
+
+// Return a channel of all recognized sequences.
+func (f FlatRecognizer) AllSequences() <-chan []byte {
+	return f.ConstrainedSequences(BaseConstraints{})
+}
+
+// Return a channel of all recognized sequences that begin with prefix.
+func (f FlatRecognizer) PrefixSequences(prefix []byte) <-chan []byte {
+	return f.ConstrainedSequences(PrefixConstraints(prefix))
+}
+
+// Return a channel of all recognized sequences that can be produced from input
+// using mapping, as with Recognizer.MappedSequences.
+func (f FlatRecognizer) MappedSequences(input []byte, mapping map[byte][]byte) <-chan []byte {
+	return f.ConstrainedSequences(mappedConstraints(input, mapping))
+}
+
+// Return up to limit recognized sequences that begin with prefix, as with
+// Recognizer.Completions.
+func (f FlatRecognizer) Completions(prefix []byte, limit int) [][]byte {
+	return completions(f, prefix, limit)
+}
+
+// Return the number of recognized sequences that begin with prefix, as with
+// Recognizer.CountSequences.
+func (f FlatRecognizer) CountSequences(prefix []byte) int64 {
+	return countSequences(f, prefix)
+}
+
+// Return recognized sequences close to value, as with Recognizer.Suggest.
+func (f FlatRecognizer) Suggest(value []byte, maxEdits, limit int) []Suggestion {
+	return suggest(f, value, maxEdits, limit)
+}
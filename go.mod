@@ -0,0 +1,5 @@
+module github.com/shiblon/mealy
+
+go 1.18
+
+require golang.org/x/text v0.22.0
@@ -0,0 +1,127 @@
+package mealy
+
+import (
+	"bytes"
+	"sort"
+)
+
+// Specifies which cells count as neighbors when searching a grid.
+type Adjacency int
+
+const (
+	// Horizontal, vertical, and diagonal neighbors (as in Boggle).
+	Adjacent8 Adjacency = iota
+	// Horizontal and vertical neighbors only.
+	Adjacent4
+)
+
+var neighborOffsets = map[Adjacency][][2]int{
+	Adjacent8: {{-1, -1}, {-1, 0}, {-1, 1}, {0, -1}, {0, 1}, {1, -1}, {1, 0}, {1, 1}},
+	Adjacent4: {{-1, 0}, {0, -1}, {0, 1}, {1, 0}},
+}
+
+// Options for FindInGrid. The zero value searches all 8 neighbors, forbids
+// reusing a cell within a single word, and reports words of any length.
+type GridOptions struct {
+	Adjacency Adjacency
+	// Allow a path to visit the same cell more than once.
+	AllowReuse bool
+	// Minimum length of a reported word, in bytes.
+	MinLength int
+}
+
+// A cell position in a grid, given as row and column.
+type GridCell struct {
+	Row, Col int
+}
+
+// A word found in a grid, along with the cells that spell it out.
+type GridWord struct {
+	Word []byte
+	Path []GridCell
+}
+
+// Find all recognized sequences that can be spelled by walking between
+// adjacent cells of the grid. The grid is indexed by row, then column, and
+// each cell holds one or more bytes, so multi-letter cells like "QU" are
+// supported. Empty cells are never entered.
+//
+// Each word is reported once, with the first path found for it, and results
+// are ordered by word. The search steps through the machine as it goes, so
+// any path whose prefix cannot lead to a recognized sequence is abandoned
+// immediately.
+func (self Recognizer) FindInGrid(grid [][][]byte, opts GridOptions) []GridWord {
+	offsets, ok := neighborOffsets[opts.Adjacency]
+	if !ok || len(self) == 0 {
+		return nil
+	}
+
+	visited := make([][]bool, len(grid))
+	for r, row := range grid {
+		visited[r] = make([]bool, len(row))
+	}
+
+	found := make(map[string]GridWord)
+	word := []byte{}
+	path := []GridCell{}
+
+	var search func(r, c, id int)
+	search = func(r, c, id int) {
+		cell := grid[r][c]
+		if len(cell) == 0 {
+			return
+		}
+		terminal, ok := false, true
+		for _, b := range cell {
+			if id, terminal, ok = self.Step(id, b); !ok {
+				return
+			}
+		}
+
+		word = append(word, cell...)
+		path = append(path, GridCell{r, c})
+		visited[r][c] = true
+		defer func() {
+			word = word[:len(word)-len(cell)]
+			path = path[:len(path)-1]
+			visited[r][c] = false
+		}()
+
+		if terminal && len(word) >= opts.MinLength {
+			if _, seen := found[string(word)]; !seen {
+				found[string(word)] = GridWord{
+					Word: append([]byte{}, word...),
+					Path: append([]GridCell{}, path...),
+				}
+			}
+		}
+		if self[id].IsEmpty() {
+			return
+		}
+		for _, off := range offsets {
+			nr, nc := r+off[0], c+off[1]
+			if nr < 0 || nr >= len(grid) || nc < 0 || nc >= len(grid[nr]) {
+				continue
+			}
+			if !opts.AllowReuse && visited[nr][nc] {
+				continue
+			}
+			search(nr, nc, id)
+		}
+	}
+
+	for r, row := range grid {
+		for c := range row {
+			search(r, c, self.StartId())
+		}
+	}
+
+	words := make([]GridWord, 0, len(found))
+	for _, w := range found {
+		words = append(words, w)
+	}
+	sort.Slice(words, func(i, j int) bool {
+		return bytes.Compare(words[i].Word, words[j].Word) < 0
+	})
+	return words
+}
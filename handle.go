@@ -0,0 +1,170 @@
+package mealy
+
+import (
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"time"
+)
+
+// Holds a Recognizer that can be replaced while it is being queried. Queries
+// load the current machine atomically and never lock, and a query that is in
+// progress when the machine is swapped finishes with the machine it started
+// with.
+//
+// The zero value holds an empty machine, which recognizes nothing.
+type Handle struct {
+	current atomic.Value
+}
+
+// Create a Handle holding m.
+func NewHandle(m Recognizer) *Handle {
+	h := &Handle{}
+	h.Swap(m)
+	return h
+}
+
+// A machine that recognizes nothing, with only a start state.
+var emptyRecognizer = Recognizer{{}}
+
+// Return the current machine. It remains valid, and safe to query, after it
+// has been swapped out. If no machine (or one with no states) has been swapped
+// in, this is a machine with only a start state.
+func (h *Handle) Recognizer() Recognizer {
+	m, _ := h.current.Load().(Recognizer)
+	if len(m) == 0 {
+		return emptyRecognizer
+	}
+	return m
+}
+
+// Replace the current machine with m, returning the one it replaced.
+func (h *Handle) Swap(m Recognizer) Recognizer {
+	old, _ := h.current.Swap(m).(Recognizer)
+	return old
+}
+
+// Read a machine in any serialization format from path and swap it in. On
+// error, the current machine is kept.
+func (h *Handle) Load(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	m, err := ReadFrom(file)
+	if err != nil {
+		return err
+	}
+	h.Swap(m)
+	return nil
+}
+
+// Check path every interval, and Load it whenever its modification time or
+// size changes. After each attempt, report (if not nil) is called with the
+// error from Load, or nil on success; after a failure, the next check tries
+// again. Call the returned function to stop watching.
+func (h *Handle) WatchFile(path string, interval time.Duration, report func(err error)) (stop func()) {
+	done := make(chan struct{})
+	info, _ := os.Stat(path)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			latest, err := os.Stat(path)
+			if err == nil && info != nil && latest.ModTime().Equal(info.ModTime()) && latest.Size() == info.Size() {
+				continue
+			}
+			if err == nil {
+				err = h.Load(path)
+			}
+			if err == nil {
+				info = latest
+			}
+			if report != nil {
+				report(err)
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// Load path each time one of the given signals (typically syscall.SIGHUP) is
+// received. Results are passed to report as for WatchFile. Call the returned
+// function to stop listening.
+func (h *Handle) ReloadOnSignal(path string, report func(err error), sigs ...os.Signal) (stop func()) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, sigs...)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-c:
+			}
+			err := h.Load(path)
+			if report != nil {
+				report(err)
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(c)
+		close(done)
+	}
+}
+
+// Report whether the current machine recognizes value.
+func (h *Handle) Recognizes(value []byte) bool {
+	return h.Recognizer().Recognizes(value)
+}
+
+// Return a channel of all sequences the current machine recognizes.
+func (h *Handle) AllSequences() <-chan []byte {
+	m := h.Recognizer()
+	return m.AllSequences()
+}
+
+// Return a channel of the sequences the current machine recognizes that meet
+// the given constraints.
+func (h *Handle) ConstrainedSequences(con Constraints) <-chan []byte {
+	m := h.Recognizer()
+	return m.ConstrainedSequences(con)
+}
+
+// Return a channel of the sequences the current machine recognizes that begin
+// with prefix.
+func (h *Handle) PrefixSequences(prefix []byte) <-chan []byte {
+	m := h.Recognizer()
+	return m.PrefixSequences(prefix)
+}
+
+// Return a channel of the sequences the current machine recognizes that can be
+// produced from input using mapping, as with Recognizer.MappedSequences.
+func (h *Handle) MappedSequences(input []byte, mapping map[byte][]byte) <-chan []byte {
+	m := h.Recognizer()
+	return m.MappedSequences(input, mapping)
+}
+
+// Return up to limit sequences that begin with prefix, as with
+// Recognizer.Completions.
+func (h *Handle) Completions(prefix []byte, limit int) [][]byte {
+	return h.Recognizer().Completions(prefix, limit)
+}
+
+// Return the number of sequences that begin with prefix, as with
+// Recognizer.CountSequences.
+func (h *Handle) CountSequences(prefix []byte) int64 {
+	return h.Recognizer().CountSequences(prefix)
+}
+
+// Return sequences close to value, as with Recognizer.Suggest.
+func (h *Handle) Suggest(value []byte, maxEdits, limit int) []Suggestion {
+	return h.Recognizer().Suggest(value, maxEdits, limit)
+}
@@ -0,0 +1,201 @@
+package mealy
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+)
+
+// How keys are delimited or encoded in an input stream.
+type KeyFormat int
+
+const (
+	// One key per line. A trailing "\n" or "\r\n" is removed, and the last
+	// line need not end with a newline.
+	KeysLines KeyFormat = iota
+	// Keys terminated (or separated) by NUL bytes, so they may contain
+	// newlines.
+	KeysNUL
+	// Each key is preceded by its length as a uvarint, so it may contain any
+	// bytes.
+	KeysUvarint
+	// One hex-encoded key per line.
+	KeysHex
+	// One standard base64-encoded key per line.
+	KeysBase64
+)
+
+var keyFormatNames = map[KeyFormat]string{
+	KeysLines:   "lines",
+	KeysNUL:     "nul",
+	KeysUvarint: "uvarint",
+	KeysHex:     "hex",
+	KeysBase64:  "base64",
+}
+
+func (f KeyFormat) String() string {
+	if name, ok := keyFormatNames[f]; ok {
+		return name
+	}
+	return fmt.Sprintf("KeyFormat(%d)", int(f))
+}
+
+// Return the key format with the given name: lines, nul, uvarint, hex, or
+// base64.
+func ParseKeyFormat(name string) (KeyFormat, error) {
+	for f, n := range keyFormatNames {
+		if n == name {
+			return f, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown key format %q", name)
+}
+
+// The longest key a KeyReader accepts in KeysUvarint, so that a corrupt
+// length cannot make it allocate without bound.
+const MaxKeyLen = 1 << 20
+
+// Reads keys from a stream in one of the KeyFormats. Input compressed with
+// gzip is detected and decompressed automatically.
+type KeyReader struct {
+	r      *bufio.Reader
+	format KeyFormat
+	err    error
+}
+
+// Create a KeyReader for r, which is checked for gzip compression.
+func NewKeyReader(r io.Reader, format KeyFormat) (*KeyReader, error) {
+	if _, ok := keyFormatNames[format]; !ok {
+		return nil, fmt.Errorf("unknown key format %v", format)
+	}
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		br = bufio.NewReader(zr)
+	}
+	return &KeyReader{r: br, format: format}, nil
+}
+
+// Read up to and including the delimiter, returning what came before it. The
+// final piece need not be delimited. Returns io.EOF only when nothing is left.
+func (kr *KeyReader) readDelimited(delim byte) ([]byte, error) {
+	piece, err := kr.r.ReadBytes(delim)
+	if err == io.EOF && len(piece) > 0 {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(piece, []byte{delim}), nil
+}
+
+// Return the next key, or io.EOF when there are no more. Once an error has
+// been returned, it is returned for every later call.
+func (kr *KeyReader) Next() ([]byte, error) {
+	if kr.err != nil {
+		return nil, kr.err
+	}
+	var key []byte
+	switch kr.format {
+	case KeysNUL:
+		key, kr.err = kr.readDelimited(0)
+	case KeysUvarint:
+		var n uint64
+		if n, kr.err = binary.ReadUvarint(kr.r); kr.err != nil {
+			break
+		}
+		if n > MaxKeyLen {
+			kr.err = fmt.Errorf("key length %d exceeds the maximum of %d", n, MaxKeyLen)
+			break
+		}
+		key = make([]byte, n)
+		if _, kr.err = io.ReadFull(kr.r, key); kr.err == io.EOF {
+			kr.err = io.ErrUnexpectedEOF
+		}
+	default:
+		var line []byte
+		if line, kr.err = kr.readDelimited('\n'); kr.err != nil {
+			break
+		}
+		switch kr.format {
+		case KeysLines:
+			key = bytes.TrimSuffix(line, []byte("\r"))
+		case KeysHex:
+			line = bytes.TrimSpace(line)
+			key = make([]byte, hex.DecodedLen(len(line)))
+			_, kr.err = hex.Decode(key, line)
+		case KeysBase64:
+			line = bytes.TrimSpace(line)
+			key = make([]byte, base64.StdEncoding.DecodedLen(len(line)))
+			var n int
+			n, kr.err = base64.StdEncoding.Decode(key, line)
+			key = key[:n]
+		}
+	}
+	if kr.err != nil {
+		return nil, kr.err
+	}
+	return key, nil
+}
+
+// Return the first error other than io.EOF encountered, if any. This must be
+// checked after the channel returned by Keys has been drained.
+func (kr *KeyReader) Err() error {
+	if kr.err == io.EOF {
+		return nil
+	}
+	return kr.err
+}
+
+// Return a channel of all remaining keys, closed at the end of input or at the
+// first error.
+func (kr *KeyReader) Keys() <-chan []byte {
+	out := make(chan []byte)
+	go func() {
+		defer close(out)
+		for {
+			key, err := kr.Next()
+			if err != nil {
+				return
+			}
+			out <- key
+		}
+	}()
+	return out
+}
+
+// Build a new mealy machine from keys read from r in the given format, which
+// may be compressed with gzip. Keys must be in strictly increasing order, as
+// for FromChannel, except that empty keys are skipped. For unsorted keys, pass
+// the channel from a KeyReader to FromUnsorted.
+func FromReader(r io.Reader, format KeyFormat) (Recognizer, error) {
+	kr, err := NewKeyReader(r, format)
+	if err != nil {
+		return nil, err
+	}
+	b := NewBuilder(BuildOptions{})
+	for {
+		key, err := kr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(key) == 0 {
+			continue
+		}
+		if err = b.Add(key); err != nil {
+			return nil, err
+		}
+	}
+	return b.Finish()
+}
@@ -0,0 +1,173 @@
+package mealy
+
+import (
+	"bytes"
+	"sort"
+)
+
+// A set of sequences made of an immutable base machine with small sets of
+// inserted and deleted sequences layered over it. This makes small, frequent
+// changes to a large machine cheap: nothing in the base is copied, and queries
+// merge the layers in order, so they see exactly the sequences a machine built
+// from scratch would recognize. Once the layers grow, Compact folds them into
+// a new base.
+//
+// The inserted sequences never overlap the base, and the deleted ones are
+// always in it. A Layered is not safe for concurrent use if any goroutine
+// modifies it.
+type Layered struct {
+	base     Recognizer
+	inserted [][]byte
+	deleted  [][]byte
+}
+
+// Create a Layered set containing the sequences recognized by base.
+func NewLayered(base Recognizer) *Layered {
+	if len(base) == 0 {
+		base = Recognizer{{}}
+	}
+	return &Layered{base: base}
+}
+
+// Return the index of key in the sorted values, and whether it is there.
+func searchValues(values [][]byte, key []byte) (int, bool) {
+	i := sort.Search(len(values), func(i int) bool {
+		return bytes.Compare(values[i], key) >= 0
+	})
+	return i, i < len(values) && bytes.Equal(values[i], key)
+}
+
+// Insert key into the sorted values, if it is not already there.
+func insertValue(values [][]byte, key []byte) [][]byte {
+	i, found := searchValues(values, key)
+	if found {
+		return values
+	}
+	values = append(values, nil)
+	copy(values[i+1:], values[i:])
+	values[i] = append([]byte{}, key...)
+	return values
+}
+
+// Remove key from the sorted values, if it is there.
+func removeValue(values [][]byte, key []byte) [][]byte {
+	i, found := searchValues(values, key)
+	if !found {
+		return values
+	}
+	return append(values[:i], values[i+1:]...)
+}
+
+// Return true if key is recognized.
+func (l *Layered) Recognizes(key []byte) bool {
+	if _, found := searchValues(l.inserted, key); found {
+		return true
+	}
+	if _, found := searchValues(l.deleted, key); found {
+		return false
+	}
+	return l.base.Recognizes(key)
+}
+
+// Add key to the recognized sequences. Returns false if key is empty, since
+// empty sequences cannot be represented, or if it is already recognized.
+func (l *Layered) Insert(key []byte) bool {
+	if len(key) == 0 || l.Recognizes(key) {
+		return false
+	}
+	if l.base.Recognizes(key) {
+		l.deleted = removeValue(l.deleted, key)
+	} else {
+		l.inserted = insertValue(l.inserted, key)
+	}
+	return true
+}
+
+// Remove key from the recognized sequences. Returns false if it was not there.
+func (l *Layered) Delete(key []byte) bool {
+	if !l.Recognizes(key) {
+		return false
+	}
+	if l.base.Recognizes(key) {
+		l.deleted = insertValue(l.deleted, key)
+	} else {
+		l.inserted = removeValue(l.inserted, key)
+	}
+	return true
+}
+
+// Return the base machine, which does not reflect the layered changes.
+func (l *Layered) Base() Recognizer {
+	return l.base
+}
+
+// Return the number of sequences inserted and deleted since the base was
+// built, which can be used to decide when to Compact.
+func (l *Layered) Changes() (inserted, deleted int) {
+	return len(l.inserted), len(l.deleted)
+}
+
+// Merge the sorted sequences from base with the sorted inserted values,
+// skipping those that are deleted.
+func mergeLayers(base <-chan []byte, inserted, deleted [][]byte) <-chan []byte {
+	out := make(chan []byte)
+	go func() {
+		defer close(out)
+		for v := range base {
+			for len(inserted) > 0 && bytes.Compare(inserted[0], v) < 0 {
+				out <- inserted[0]
+				inserted = inserted[1:]
+			}
+			for len(deleted) > 0 && bytes.Compare(deleted[0], v) < 0 {
+				deleted = deleted[1:]
+			}
+			if len(deleted) > 0 && bytes.Equal(deleted[0], v) {
+				deleted = deleted[1:]
+				continue
+			}
+			out <- v
+		}
+		for _, v := range inserted {
+			out <- v
+		}
+	}()
+	return out
+}
+
+// Return the sorted values that begin with prefix, sharing the backing array.
+func valuesWithPrefix(values [][]byte, prefix []byte) [][]byte {
+	i, _ := searchValues(values, prefix)
+	j := i
+	for j < len(values) && bytes.HasPrefix(values[j], prefix) {
+		j++
+	}
+	return values[i:j]
+}
+
+// Return copies of the layers, so that queries in progress are unaffected by
+// later changes.
+func (l *Layered) snapshot(prefix []byte) (inserted, deleted [][]byte) {
+	inserted = append([][]byte{}, valuesWithPrefix(l.inserted, prefix)...)
+	deleted = append([][]byte{}, valuesWithPrefix(l.deleted, prefix)...)
+	return
+}
+
+// Return a channel of all recognized sequences, in order.
+func (l *Layered) AllSequences() <-chan []byte {
+	return l.PrefixSequences(nil)
+}
+
+// Return a channel of all recognized sequences that begin with prefix, in
+// order, including prefix itself if it is recognized.
+func (l *Layered) PrefixSequences(prefix []byte) <-chan []byte {
+	inserted, deleted := l.snapshot(prefix)
+	return mergeLayers(l.base.PrefixSequences(prefix), inserted, deleted)
+}
+
+// Build a new machine from the base and its layers, make it the base, and
+// return it. The layers are then empty.
+func (l *Layered) Compact() Recognizer {
+	m := FromChannel(l.AllSequences())
+	l.base, l.inserted, l.deleted = m, nil, nil
+	return m
+}
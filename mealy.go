@@ -2,11 +2,16 @@
 Implements a Mealy Machine as described in the paper at
   http://www.n3labs.com/pdf/lexicon-squeeze.pdf
 The machine is defined for byte values, and serializes with that assumption.
+
+A Recognizer (or FlatRecognizer) is never modified by its read methods, so any
+number of goroutines may query the same machine concurrently without locking.
+Only the methods that deserialize into an existing Recognizer (ReadFrom,
+UnmarshalBinary and GobDecode) modify it. To swap in a rebuilt machine while
+others are querying it, use a Handle.
 */
 package mealy
 
 import (
-	"bytes"
 	"fmt"
 	"sort"
 )
@@ -15,77 +20,21 @@ type Recognizer []state
 
 // Builds a new mealy machine from an ordered list of values. Keeps working
 // until the channel is closed, at which point it finalizes and returns.
+//
+// Panics if the values are not in strictly increasing order. Use a Builder
+// directly to get an error instead.
 func FromChannel(values <-chan []byte) Recognizer {
-	self := Recognizer{}
-
-	states := make(map[string]int)
-	terminals := []bool{false}
-	larvae := []state{{}}
-
-	prefixLen := 0
-	prevValue := []byte{}
-
-	// Find or create a state corresponding to what's passed in.
-	makeState := func(s state) (id int) {
-		fprint := s.Fingerprint()
-		var ok bool
-		if id, ok = states[fprint]; !ok {
-			id = len(self)
-			self = append(self, s)
-			states[fprint] = id
-		}
-		return
-	}
-
-	// Find the longest common prefix length.
-	commonPrefixLen := func(a, b []byte) (l int) {
-		for l = 0; l < len(a) && l < len(b) && a[l] == b[l]; l++ {
-		}
-		return
-	}
-
-	// Make all states up to but not including the prefix point.
-	// Modifies larvae by adding transitions as needed.
-	makeSuffixStates := func(p int) {
-		for i := len(prevValue); i > p; i-- {
-			larvae[i-1].AddTransition(
-				NewTransition(prevValue[i-1],
-					makeState(larvae[i]),
-					terminals[i]))
-		}
-	}
-
+	b := NewBuilder(BuildOptions{})
 	for value := range values {
-		if bytes.Compare(prevValue, value) >= 0 {
-			panic(fmt.Sprintf(
-				"Cannot build a Mealy machine from out-of-order "+
-					"values: %v : %v\n",
-				prevValue, value))
-		}
-		prefixLen = commonPrefixLen(prevValue, value)
-		makeSuffixStates(prefixLen)
-		// Go from first uncommon byte to end of new value, resetting
-		// everything (creating new states as needed).
-		larvae = larvae[:prefixLen+1]
-		terminals = terminals[:prefixLen+1]
-		for i := prefixLen + 1; i < len(value)+1; i++ {
-			larvae = append(larvae, state{})
-			terminals = append(terminals, false)
+		if err := b.Add(value); err != nil {
+			panic(err.Error())
 		}
-		terminals[len(value)] = true
-		prevValue = value
 	}
-
-	// Finish up by making all remaining states, then create a start state.
-	makeSuffixStates(0)
-	if startId := makeState(larvae[0]); startId != len(self)-1 {
-		panic(fmt.Sprintf(
-			"Unexpected start ID, not at the end: %v < %v",
-			startId, len(self)-1))
+	m, err := b.Finish()
+	if err != nil {
+		panic(err.Error())
 	}
-
-	// Start state is at len - 1; final state is at 0.
-	return self
+	return m
 }
 
 func (self Recognizer) String() string {
@@ -145,23 +94,38 @@ func (self Recognizer) AllTriggers() []byte {
 	return byteTriggers
 }
 
-func (self Recognizer) Recognizes(value []byte) bool {
-	if len(self) == 0 {
-		return false
-	}
+// Return the ID of the start state, suitable for passing to Step.
+func (self Recognizer) StartId() int {
+	return len(self) - 1
+}
 
-	var tran transition
+// Follow the transition triggered by value out of the state with the given
+// ID. Returns the ID of the state reached and whether the transition is
+// terminal, i.e., whether the bytes consumed to get here form a recognized
+// sequence. If no such transition exists, ok is false.
+//
+// Together with StartId, this allows callers to walk the machine one byte at a
+// time, pruning searches as soon as a prefix is known to be a dead end.
+func (self Recognizer) Step(id int, value byte) (next int, terminal, ok bool) {
+	if id < 0 || id >= len(self) {
+		return
+	}
+	s := self[id]
+	if i := s.IndexForTrigger(value); i < len(s) {
+		return s[i].ToState(), s[i].IsTerminal(), true
+	}
+	return
+}
 
-	state := self.Start()
+func (self Recognizer) Recognizes(value []byte) bool {
+	id, terminal := self.StartId(), false
 	for _, v := range value {
-		if found := state.IndexForTrigger(v); found < len(state) {
-			tran = state[found]
-			state = self[tran.ToState()]
-		} else {
-			break
+		var ok bool
+		if id, terminal, ok = self.Step(id, v); !ok {
+			return false
 		}
 	}
-	return tran.IsTerminal()
+	return terminal
 }
 
 type pathNode struct {
@@ -206,6 +170,25 @@ func (p *pathNode) AdvanceUntilAllowed(allowed func(byte) bool) {
 // constraints can be very helpful in reducing the amount of work done by the
 // machine to generate sequences.
 func (self *Recognizer) ConstrainedSequences(con Constraints) <-chan []byte {
+	return constrainedSequences(*self, con)
+}
+
+// The read-only view of a machine's states shared by its in-memory
+// representations. As always, the start state is the last one.
+type stateTable interface {
+	numStates() int
+	stateAt(id int) state
+}
+
+func (self Recognizer) numStates() int {
+	return len(self)
+}
+func (self Recognizer) stateAt(id int) state {
+	return self[id]
+}
+
+// Implements ConstrainedSequences for any representation.
+func constrainedSequences(t stateTable, con Constraints) <-chan []byte {
 	out := make(chan []byte)
 
 	// Advance the last element of the node path, taking constraints into
@@ -252,7 +235,7 @@ func (self *Recognizer) ConstrainedSequences(con Constraints) <-chan []byte {
 
 	go func() {
 		defer close(out)
-		path := []pathNode{{self.Start(), 0}}
+		path := []pathNode{{t.stateAt(t.numStates() - 1), 0}}
 		advanceLastUntilAllowed(path) // Needed for node initialization
 
 		for path = popExhausted(path); len(path) > 0; path = popExhausted(path) {
@@ -263,7 +246,7 @@ func (self *Recognizer) ConstrainedSequences(con Constraints) <-chan []byte {
 					out <- b
 				}
 			}
-			nextState := (*self)[curTransition.ToState()]
+			nextState := t.stateAt(curTransition.ToState())
 			if !nextState.IsEmpty() && con.IsSmallEnough(len(path)+1) {
 				node := pathNode{nextState, 0}
 				path = append(path, node)
@@ -285,3 +268,30 @@ func (self *Recognizer) ConstrainedSequences(con Constraints) <-chan []byte {
 func (self *Recognizer) AllSequences() (out <-chan []byte) {
 	return self.ConstrainedSequences(BaseConstraints{})
 }
+
+// Return a channel of all recognized sequences that can be produced from input
+// by replacing each of its bytes with one of the values that mapping lists for
+// it. Sequences are thus always the same length as input, and input bytes that
+// have no entry in mapping cannot be matched at all.
+//
+// This is the lookup performed by a phone keypad, where mapping takes each
+// digit to its letters, and "2273" yields words like "CARE" and "BASE".
+func (self *Recognizer) MappedSequences(input []byte, mapping map[byte][]byte) <-chan []byte {
+	return self.ConstrainedSequences(mappedConstraints(input, mapping))
+}
+
+func mappedConstraints(input []byte, mapping map[byte][]byte) PositionalConstraints {
+	con := make(PositionalConstraints, len(input))
+	for i, b := range input {
+		con[i] = mapping[b]
+	}
+	return con
+}
+
+// Return a channel of all recognized sequences that begin with prefix,
+// including prefix itself if it is recognized.
+//
+// This is an alias for ConstrainedSequences(PrefixConstraints(prefix)).
+func (self *Recognizer) PrefixSequences(prefix []byte) <-chan []byte {
+	return self.ConstrainedSequences(PrefixConstraints(prefix))
+}
@@ -2,9 +2,22 @@ package mealy
 
 import (
 	"bytes"
+	"compress/gzip"
+	"encoding"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/gob"
 	"errors"
 	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
 	"testing"
+	"time"
 )
 
 type TestStrings []string
@@ -34,6 +47,26 @@ func AllStrings() TestStrings {
 	}
 }
 
+// Generate a sorted list of n distinct random strings over the given
+// alphabet. Small alphabets give plenty of shared prefixes and suffixes.
+func RandomStrings(n int, alphabet string, seed int64) TestStrings {
+	r := rand.New(rand.NewSource(seed))
+	seen := make(map[string]bool)
+	values := TestStrings{}
+	for len(values) < n {
+		b := make([]byte, 1+r.Intn(8))
+		for i := range b {
+			b[i] = alphabet[r.Intn(len(alphabet))]
+		}
+		if !seen[string(b)] {
+			seen[string(b)] = true
+			values = append(values, string(b))
+		}
+	}
+	sort.Strings(values)
+	return values
+}
+
 type SizeConstraint TestStrings
 
 func (c SizeConstraint) IsLargeEnough(s int) bool          { return s >= 2 }
@@ -112,7 +145,7 @@ func EqualChannels(t *testing.T, c1, c2 <-chan []byte) error {
 // ----------------------------------------------------------------------
 // Test Functions
 // ----------------------------------------------------------------------
-func ExampleRecognizes() {
+func ExampleRecognizer_Recognizes() {
 	m := FromChannel(AllStrings().ToChannel())
 
 	fmt.Println(m.Recognizes([]byte("BAA")))
@@ -161,7 +194,7 @@ func TestSerialize(t *testing.T) {
 	m := FromChannel(AllStrings().ToChannel())
 
 	var buffer bytes.Buffer
-	if err := m.WriteTo(&buffer); err != nil {
+	if _, err := m.WriteTo(&buffer); err != nil {
 		t.Error(err.Error())
 	}
 
@@ -175,3 +208,1455 @@ func TestSerialize(t *testing.T) {
 		}
 	}
 }
+
+func TestRecognizesRejectsUnknownSuffix(t *testing.T) {
+	m := FromChannel(AllStrings().ToChannel())
+	for _, s := range []string{"AAX", "DABBERS", "", "X"} {
+		if m.Recognizes([]byte(s)) {
+			t.Errorf("Recognized %q, which was never added", s)
+		}
+	}
+}
+
+func TestStep(t *testing.T) {
+	m := FromChannel(AllStrings().ToChannel())
+	id := m.StartId()
+	for i, b := range []byte("DAB") {
+		next, terminal, ok := m.Step(id, b)
+		if !ok {
+			t.Fatalf("No transition for %q at position %d", b, i)
+		}
+		if terminal {
+			t.Errorf("Unexpected terminal transition at position %d", i)
+		}
+		id = next
+	}
+	if _, _, ok := m.Step(id, 'X'); ok {
+		t.Errorf("Unexpected transition past a dead end")
+	}
+}
+
+func TestFindInGrid(t *testing.T) {
+	m := FromChannel(TestStrings{"AB", "ABC", "ACA", "BQUA", "CAB", "QUA"}.ToChannel())
+	grid := [][][]byte{
+		{[]byte("A"), []byte("B")},
+		{[]byte("QU"), []byte("C")},
+	}
+
+	cases := []struct {
+		opts  GridOptions
+		words []string
+	}{
+		{GridOptions{}, []string{"AB", "ABC", "BQUA", "CAB", "QUA"}},
+		{GridOptions{Adjacency: Adjacent4}, []string{"AB", "ABC", "QUA"}},
+		{GridOptions{MinLength: 3}, []string{"ABC", "BQUA", "CAB", "QUA"}},
+		{GridOptions{AllowReuse: true}, []string{"AB", "ABC", "ACA", "BQUA", "CAB", "QUA"}},
+	}
+
+	for _, c := range cases {
+		found := m.FindInGrid(grid, c.opts)
+		words := make([]string, len(found))
+		for i, w := range found {
+			words[i] = string(w.Word)
+			spelled := []byte{}
+			for _, cell := range w.Path {
+				spelled = append(spelled, grid[cell.Row][cell.Col]...)
+			}
+			if string(spelled) != words[i] {
+				t.Errorf("Path for %q spells %q", words[i], spelled)
+			}
+		}
+		if fmt.Sprint(words) != fmt.Sprint(c.words) {
+			t.Errorf("FindInGrid(%+v): expected %v, got %v", c.opts, c.words, words)
+		}
+	}
+}
+
+func TestMappedSequences(t *testing.T) {
+	m := FromChannel(AllStrings().ToChannel())
+	mapping := map[byte][]byte{
+		'1': []byte("A"),
+		'2': []byte("BC"),
+		'3': []byte("D"),
+	}
+	expected := TestStrings{"AA", "BAA", "CBA", "CBB"}
+	cases := map[string]TestStrings{
+		"11":  expected[:1],
+		"211": expected[1:2],
+		"221": expected[2:3],
+		"222": expected[3:],
+		"4":   {},
+		"":    {},
+	}
+	for input, want := range cases {
+		if err := EqualChannels(t, want.ToChannel(), m.MappedSequences([]byte(input), mapping)); err != nil {
+			t.Errorf("%q: %v", input, err)
+		}
+	}
+}
+
+func TestPrefixSequences(t *testing.T) {
+	m := FromChannel(AllStrings().ToChannel())
+	cases := map[string]TestStrings{
+		"AA": {"AA", "AAA", "AAB"},
+		"D":  {"DABBER", "DOBBER"},
+		"CX": {},
+		"":   AllStrings(),
+	}
+	for prefix, want := range cases {
+		if err := EqualChannels(t, want.ToChannel(), m.PrefixSequences([]byte(prefix))); err != nil {
+			t.Errorf("%q: %v", prefix, err)
+		}
+	}
+}
+
+func TestSuffixIndex(t *testing.T) {
+	x, err := NewSuffixIndex(FromChannel(AllStrings().ToChannel()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := EqualChannels(t, TestStrings{"AA", "AAA", "BAA"}.ToChannel(), x.SuffixSequences([]byte("AA"))); err != nil {
+		t.Error(err)
+	}
+	if err := EqualChannels(t, TestStrings{"DABBER", "DOBBER"}.ToChannel(), x.SuffixSequences([]byte("BER"))); err != nil {
+		t.Error(err)
+	}
+	for s, want := range map[string]bool{"BER": true, "CBA": true, "BA": true, "ABA": false, "": true} {
+		if got := x.HasSuffix([]byte(s)); got != want {
+			t.Errorf("HasSuffix(%q): expected %t, got %t", s, want, got)
+		}
+	}
+}
+
+func TestSubstringIndex(t *testing.T) {
+	x, err := NewSubstringIndex(FromChannel(AllStrings().ToChannel()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]TestStrings{
+		"BB":  {"CBB", "DABBER", "DOBBER"},
+		"AB":  {"AAB", "DABBER"},
+		"OBB": {"DOBBER"},
+		"BBB": {},
+	}
+	for sub, want := range cases {
+		if got := x.Contains([]byte(sub)); got != (len(want) > 0) {
+			t.Errorf("Contains(%q): got %t", sub, got)
+		}
+		if err := EqualChannels(t, want.ToChannel(), x.SubstringSequences([]byte(sub))); err != nil {
+			t.Errorf("%q: %v", sub, err)
+		}
+	}
+}
+
+func TestAllSuffixesWith(t *testing.T) {
+	strings := RandomStrings(300, "ABCD", 9)
+	m := FromChannel(strings.ToChannel())
+	seen := make(map[string]bool)
+	for _, s := range strings {
+		for i := range s {
+			seen[s[i:]] = true
+		}
+	}
+	want := TestStrings{}
+	for s := range seen {
+		want = append(want, s)
+	}
+	sort.Strings(want)
+
+	// A tiny budget forces the suffixes to be sorted in runs on disk.
+	suffixes, err := m.AllSuffixesWith(SortOptions{MemoryBudget: 100, TempDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := EqualChannels(t, want.ToChannel(), suffixes.AllSequences()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReversedWith(t *testing.T) {
+	strings := RandomStrings(300, "ABCD", 9)
+	want := TestStrings{}
+	for _, s := range strings {
+		want = append(want, string(reversedBytes([]byte(s))))
+	}
+	sort.Strings(want)
+
+	m := FromChannel(strings.ToChannel())
+	reversed, err := m.ReversedWith(SortOptions{MemoryBudget: 100, TempDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := EqualChannels(t, want.ToChannel(), reversed.AllSequences()); err != nil {
+		t.Error(err)
+	}
+	if _, err := m.ReversedWith(SortOptions{MemoryBudget: 100, TempDir: filepath.Join(t.TempDir(), "missing")}); err == nil {
+		t.Errorf("Expected an error when runs cannot be written")
+	}
+}
+
+func TestSegment(t *testing.T) {
+	m := FromChannel(AllStrings().ToChannel())
+	cases := map[string]string{
+		"DABBERDOBBER": "[DABBER DOBBER]",
+		"AAAB":         "[A AAB]",
+		"AAAAB":        "[AA AAB]",
+		"CBAX":         "[]",
+		"":             "[]",
+	}
+	for text, want := range cases {
+		if got := fmt.Sprintf("%s", m.Segment([]byte(text))); got != want {
+			t.Errorf("Segment(%q): expected %s, got %s", text, want, got)
+		}
+	}
+
+	// Prefer the split with the most single-letter words.
+	got := m.SegmentScored([]byte("AAA"), func(w []byte) float64 {
+		if len(w) == 1 {
+			return 1
+		}
+		return 0
+	})
+	if want := "[A A A]"; fmt.Sprintf("%s", got) != want {
+		t.Errorf("SegmentScored: expected %s, got %s", want, got)
+	}
+}
+
+func TestAllSegmentations(t *testing.T) {
+	m := FromChannel(AllStrings().ToChannel())
+	want := "[[A A A] [A AA] [AA A] [AAA]]"
+	if got := fmt.Sprintf("%s", m.AllSegmentations([]byte("AAA"), 0)); got != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	want = "[[A A A] [A AA]]"
+	if got := fmt.Sprintf("%s", m.AllSegmentations([]byte("AAA"), 2)); got != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if got := m.AllSegmentations([]byte("AAX"), 0); len(got) != 0 {
+		t.Errorf("Expected no segmentations, got %s", got)
+	}
+}
+
+func TestScanner(t *testing.T) {
+	m := FromChannel(AllStrings().ToChannel())
+	text := "XAABXDOBBERCBBA"
+
+	cases := []struct {
+		opts ScanOptions
+		want string
+	}{
+		{ScanOptions{}, "[{1 A} {1 AA} {2 A} {1 AAB} {5 DOBBER} {11 CBB} {14 A}]"},
+		{ScanOptions{LeftmostLongest: true}, "[{1 AAB} {5 DOBBER} {11 CBB} {14 A}]"},
+	}
+	for _, c := range cases {
+		matches := []string{}
+		s := NewScanner(m, c.opts, func(match Match) {
+			matches = append(matches, fmt.Sprintf("{%d %s}", match.Offset, match.Word))
+		})
+		// Feed in small chunks to make sure matches span writes.
+		for i := 0; i < len(text); i += 3 {
+			end := i + 3
+			if end > len(text) {
+				end = len(text)
+			}
+			s.Write([]byte(text[i:end]))
+		}
+		s.Close()
+		if got := fmt.Sprint(matches); got != c.want {
+			t.Errorf("%+v: expected %s, got %s", c.opts, c.want, got)
+		}
+	}
+}
+
+func TestMutable(t *testing.T) {
+	all := AllStrings()
+	m, err := NewMutable(FromChannel(TestStrings{"AAA", "CBB", "DOBBER"}.ToChannel()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range all {
+		if _, err := m.Insert([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ok, _ := m.Insert([]byte("AAA")); ok {
+		t.Errorf("Inserted AAA twice")
+	}
+	built := FromChannel(all.ToChannel())
+	got := m.Recognizer()
+	if len(got) != len(built) {
+		t.Errorf("Expected minimal machine with %d states, got %d", len(built), len(got))
+	}
+	if err := EqualChannels(t, all.ToChannel(), got.AllSequences()); err != nil {
+		t.Error(err)
+	}
+
+	for _, s := range []string{"DABBER", "AA", "BAA"} {
+		if ok, err := m.Delete([]byte(s)); !ok || err != nil {
+			t.Errorf("Failed to delete %q: %v", s, err)
+		}
+	}
+	if ok, _ := m.Delete([]byte("AA")); ok {
+		t.Errorf("Deleted AA twice")
+	}
+	remaining := TestStrings{"A", "AAA", "AAB", "CBA", "CBB", "DOBBER"}
+	built = FromChannel(remaining.ToChannel())
+	got = m.Recognizer()
+	if len(got) != len(built) {
+		t.Errorf("Expected minimal machine with %d states, got %d", len(built), len(got))
+	}
+	if err := EqualChannels(t, remaining.ToChannel(), got.AllSequences()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMutableCapacity(t *testing.T) {
+	strings := RandomStrings(300, "ABCD", 3)
+	built := FromChannel(strings.ToChannel())
+	m, err := NewMutable(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Far less than the discarded states would need, so it must compact.
+	m.capacity = 2 * len(built)
+	for _, s := range strings {
+		if _, err := m.Insert([]byte(s)); err != nil {
+			t.Fatalf("Inserting %q: %v", s, err)
+		}
+	}
+	if got := m.Recognizer(); !reflect.DeepEqual(got, built) {
+		t.Errorf("Expected the same machine as FromChannel")
+	}
+
+	m.capacity = len(built) + 1
+	if _, err := m.Insert([]byte("DDDDDDDDDDDD")); err != ErrTooManyStates {
+		t.Errorf("Expected ErrTooManyStates, got %v", err)
+	}
+	if got := m.Recognizer(); !reflect.DeepEqual(got, built) {
+		t.Errorf("Expected a failed insert to leave the machine unchanged")
+	}
+}
+
+func TestFromUnsorted(t *testing.T) {
+	values := TestStrings{"DOBBER", "AA", "CBB", "A", "", "AAB", "BAA", "AA", "DABBER", "AAA", "CBA", "A"}
+	for _, budget := range []int{0, 1, 60} {
+		m, err := FromUnsorted(values.ToChannel(), SortOptions{MemoryBudget: budget, TempDir: t.TempDir()})
+		if err != nil {
+			t.Fatalf("Budget %d: %v", budget, err)
+		}
+		if err := EqualChannels(t, AllStrings().ToChannel(), m.AllSequences()); err != nil {
+			t.Errorf("Budget %d: %v", budget, err)
+		}
+	}
+}
+
+func TestSorterClose(t *testing.T) {
+	dir := t.TempDir()
+	s := NewSorter(SortOptions{MemoryBudget: 1, TempDir: dir})
+	for _, v := range AllStrings() {
+		if err := s.Add([]byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if files, _ := os.ReadDir(dir); len(files) == 0 {
+		t.Fatalf("Expected sorted runs in %s", dir)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Errorf("Expected no files left after Close, found %d", len(files))
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("Second Close failed: %v", err)
+	}
+}
+
+func TestFromChannelParallel(t *testing.T) {
+	for _, strings := range []TestStrings{{}, AllStrings(), RandomStrings(5000, "ABCDEFGH", 1)} {
+		for _, workers := range []int{0, 1, 3} {
+			expected := FromChannel(strings.ToChannel())
+			m, err := FromChannelParallel(strings.ToChannel(), workers, BuildOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(expected, m) {
+				t.Errorf("Parallel build with %d workers differs from sequential for %d strings", workers, len(strings))
+			}
+		}
+	}
+
+	for _, bad := range []TestStrings{{"B", "A"}, {"A", "B", "B"}, {""}, {"A", "BA", "BB", "BA", "C"}} {
+		if _, err := FromChannelParallel(bad.ToChannel(), 2, BuildOptions{}); err == nil {
+			t.Errorf("Expected an error building from %q", bad)
+		}
+	}
+	strings := RandomStrings(5000, "ABCDEFGH", 1)
+	if _, err := FromChannelParallel(strings.ToChannel(), 3, BuildOptions{MaxRegistryBytes: 10000}); err != ErrRegistryFull {
+		t.Errorf("Expected ErrRegistryFull, got %v", err)
+	}
+}
+
+func benchmarkBuild(b *testing.B, build func(values <-chan []byte) Recognizer) {
+	strings := RandomStrings(200000, wideAlphabet, 5)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		build(strings.ToChannel())
+	}
+}
+
+func BenchmarkFromChannel(b *testing.B) {
+	benchmarkBuild(b, FromChannel)
+}
+
+func BenchmarkFromChannelParallel(b *testing.B) {
+	benchmarkBuild(b, func(values <-chan []byte) Recognizer {
+		m, err := FromChannelParallel(values, 0, BuildOptions{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		return m
+	})
+}
+
+func TestBuilder(t *testing.T) {
+	b := NewBuilder(BuildOptions{})
+	for _, s := range AllStrings() {
+		if err := b.Add([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := b.Stats()
+	if stats.Values != len(AllStrings()) || stats.States != len(m) || stats.PeakRegistryBytes <= 0 {
+		t.Errorf("Unexpected stats %+v for machine with %d states", stats, len(m))
+	}
+	if !reflect.DeepEqual(m, FromChannel(AllStrings().ToChannel())) {
+		t.Errorf("Builder and FromChannel disagree")
+	}
+
+	b = NewBuilder(BuildOptions{})
+	b.Add([]byte("B"))
+	if err := b.Add([]byte("A")); err == nil {
+		t.Errorf("Expected an error for out-of-order values")
+	}
+	if _, err := b.Finish(); err == nil {
+		t.Errorf("Expected Finish to fail after an error")
+	}
+
+	b = NewBuilder(BuildOptions{MaxRegistryBytes: 8192})
+	for _, s := range RandomStrings(1000, "ABCDEFGH", 2) {
+		if err = b.Add([]byte(s)); err != nil {
+			break
+		}
+	}
+	if err != ErrRegistryFull {
+		t.Errorf("Expected ErrRegistryFull, got %v", err)
+	}
+
+	b = NewBuilder(BuildOptions{})
+	b.reg.capacity = 100
+	for _, s := range RandomStrings(1000, "ABCDEFGH", 2) {
+		if err = b.Add([]byte(s)); err != nil {
+			break
+		}
+	}
+	if err != ErrTooManyStates {
+		t.Errorf("Expected ErrTooManyStates, got %v", err)
+	}
+	if _, err := b.Finish(); err != ErrTooManyStates {
+		t.Errorf("Expected Finish to fail with ErrTooManyStates, got %v", err)
+	}
+}
+
+func TestFlatRecognizer(t *testing.T) {
+	m := FromChannel(AllStrings().ToChannel())
+
+	b := NewBuilder(BuildOptions{})
+	for _, s := range AllStrings() {
+		b.Add([]byte(s))
+	}
+	built, err := b.FinishFlat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := b.Stats(); stats.Values != len(AllStrings()) || stats.States != len(m) || stats.PeakRegistryBytes <= 0 {
+		t.Errorf("Unexpected stats %+v after FinishFlat for machine with %d states", stats, len(m))
+	}
+
+	var buffer bytes.Buffer
+	if _, err := m.WriteTo(&buffer); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadFlatFrom(&buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range []FlatRecognizer{NewFlatRecognizer(m), built, read} {
+		if !reflect.DeepEqual(m, f.Recognizer()) {
+			t.Errorf("Flat machine has different states:\n%v\n%v", m, f.Recognizer())
+		}
+		if err := EqualChannels(t, AllStrings().ToChannel(), f.AllSequences()); err != nil {
+			t.Error(err)
+		}
+		for _, s := range []string{"AAB", "DOBBER", "DOBB", "AAX"} {
+			if f.Recognizes([]byte(s)) != m.Recognizes([]byte(s)) {
+				t.Errorf("Flat and original machines disagree about %q", s)
+			}
+		}
+	}
+}
+
+const wideAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+func TestDenseTables(t *testing.T) {
+	strings := RandomStrings(5000, wideAlphabet, 3)
+	m := FromChannel(strings.ToChannel())
+	sparse := NewFlatRecognizer(m).WithDenseFanout(0)
+	dense := NewFlatRecognizer(m)
+	if dense.dense == nil || dense.dense[dense.StartId()] < 0 {
+		t.Fatalf("Expected a dense table for the start state")
+	}
+	for _, s := range append(strings, "AAAA", "zzzzzzzz", "A!", "Zz") {
+		if dense.Recognizes([]byte(s)) != sparse.Recognizes([]byte(s)) {
+			t.Errorf("Dense and sparse machines disagree about %q", s)
+		}
+	}
+	if err := EqualChannels(t, strings.ToChannel(), dense.AllSequences()); err != nil {
+		t.Error(err)
+	}
+}
+
+// Recognizes throughput for each in-memory layout, over a lexicon whose
+// shallow states have high fanout.
+func benchmarkRecognizes(b *testing.B, recognizes func([]byte) bool) {
+	strings, _ := benchmarkLexicon()
+	values := make([][]byte, len(strings))
+	for i, s := range strings {
+		values[i] = []byte(s)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		recognizes(values[i%len(values)])
+	}
+}
+
+func BenchmarkRecognizes(b *testing.B) {
+	_, m := benchmarkLexicon()
+	benchmarkRecognizes(b, m.Recognizes)
+}
+
+func BenchmarkRecognizesFlatSparse(b *testing.B) {
+	_, m := benchmarkLexicon()
+	f := NewFlatRecognizer(m).WithDenseFanout(0)
+	benchmarkRecognizes(b, f.Recognizes)
+}
+
+func BenchmarkRecognizesFlatDense(b *testing.B) {
+	_, m := benchmarkLexicon()
+	f := NewFlatRecognizer(m)
+	benchmarkRecognizes(b, f.Recognizes)
+}
+
+func TestReorder(t *testing.T) {
+	strings := RandomStrings(2000, "ABCDEFGH", 5)
+	m := FromChannel(strings.ToChannel())
+	for _, strategy := range []ReorderStrategy{BreadthFirst(), ByFrequency(AllStrings().ToChannel())} {
+		r := m.Reorder(strategy)
+		if len(r) != len(m) {
+			t.Errorf("Reordered machine has %d states, expected %d", len(r), len(m))
+		}
+		if err := EqualChannels(t, strings.ToChannel(), r.AllSequences()); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// Breadth-first puts the start state's children right before it.
+	r := m.Reorder(BreadthFirst())
+	for i, tr := range r.Start() {
+		if want := len(r) - 2 - i; tr.ToState() != want {
+			t.Errorf("Child %d of start is state %d, expected %d", i, tr.ToState(), want)
+		}
+	}
+}
+
+func benchmarkLexicon() (TestStrings, Recognizer) {
+	strings := RandomStrings(50000, wideAlphabet, 4)
+	return strings, FromChannel(strings.ToChannel())
+}
+
+func BenchmarkRecognizesReordered(b *testing.B) {
+	_, m := benchmarkLexicon()
+	m = m.Reorder(BreadthFirst())
+	benchmarkRecognizes(b, m.Recognizes)
+}
+
+func BenchmarkRecognizesFlatReordered(b *testing.B) {
+	_, m := benchmarkLexicon()
+	f := NewFlatRecognizer(m.Reorder(BreadthFirst()))
+	benchmarkRecognizes(b, f.Recognizes)
+}
+
+func benchmarkPrefixSequences(b *testing.B, m Recognizer) {
+	prefixes := []string{}
+	for _, c := range wideAlphabet {
+		prefixes = append(prefixes, string(c))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for range m.PrefixSequences([]byte(prefixes[i%len(prefixes)])) {
+		}
+	}
+}
+
+func BenchmarkPrefixSequences(b *testing.B) {
+	_, m := benchmarkLexicon()
+	benchmarkPrefixSequences(b, m)
+}
+
+func BenchmarkPrefixSequencesReordered(b *testing.B) {
+	_, m := benchmarkLexicon()
+	benchmarkPrefixSequences(b, m.Reorder(BreadthFirst()))
+}
+
+func TestSerializeFormats(t *testing.T) {
+	for _, strings := range []TestStrings{{}, AllStrings(), RandomStrings(3000, wideAlphabet, 6)} {
+		m := FromChannel(strings.ToChannel())
+		sizes := make(map[Format]int)
+		for _, format := range []Format{FormatPlain, FormatPacked, FormatVarint, FormatIndexed} {
+			var buffer bytes.Buffer
+			if err := m.WriteFormat(&buffer, format); err != nil {
+				t.Fatal(err)
+			}
+			sizes[format] = buffer.Len()
+			read, err := ReadFrom(&buffer)
+			if err != nil {
+				t.Fatalf("Format %v: %v", format, err)
+			}
+			if m.String() != read.String() {
+				t.Errorf("Format %v: deserialized machine differs", format)
+			}
+		}
+		if len(strings) > 100 && (sizes[FormatPacked] >= sizes[FormatPlain] || sizes[FormatVarint] >= sizes[FormatPlain]) {
+			t.Errorf("Compact formats are no smaller than plain: %v", sizes)
+		}
+	}
+
+	if _, err := ReadFrom(bytes.NewBufferString("MMeMv0")); err == nil {
+		t.Errorf("Expected an error for an unknown format")
+	}
+}
+
+func TestReadConsecutiveMachines(t *testing.T) {
+	m := FromChannel(RandomStrings(500, "ABCDEFGH", 8).ToChannel())
+	formats := []Format{FormatPlain, FormatPacked, FormatVarint, FormatIndexed}
+	var buffer bytes.Buffer
+	sizes := []int{}
+	for _, format := range formats {
+		before := buffer.Len()
+		if err := m.WriteFormat(&buffer, format); err != nil {
+			t.Fatal(err)
+		}
+		sizes = append(sizes, buffer.Len()-before)
+	}
+	// A bytes.Buffer is an io.ByteReader, so nothing past each machine is read.
+	for i, format := range formats {
+		var read Recognizer
+		n, err := read.ReadFrom(&buffer)
+		if err != nil {
+			t.Fatalf("Format %v: %v", format, err)
+		}
+		if int(n) != sizes[i] {
+			t.Errorf("Format %v: read %d bytes, expected %d", format, n, sizes[i])
+		}
+		if m.String() != read.String() {
+			t.Errorf("Format %v: deserialized machine differs", format)
+		}
+	}
+}
+
+func TestReadPlainFixture(t *testing.T) {
+	// A machine recognizing only "A", as written by the original format.
+	fixture := []byte("MMeMv1\x00\x00\x00\x02\x00\x01\x41\x80\x00\x00")
+	m, err := ReadFrom(bytes.NewReader(fixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := EqualChannels(t, TestStrings{"A"}.ToChannel(), m.AllSequences()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReaderAtRecognizer(t *testing.T) {
+	strings := RandomStrings(3000, "ABCDEFGH", 7)
+	m := FromChannel(strings.ToChannel())
+	var buffer bytes.Buffer
+	if err := m.WriteFormat(&buffer, FormatIndexed); err != nil {
+		t.Fatal(err)
+	}
+	r, err := OpenReaderAt(bytes.NewReader(buffer.Bytes()), int64(buffer.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range append(TestStrings{"HHHHHHHHH", "AX", ""}, strings[:200]...) {
+		if got, err := r.Recognizes([]byte(s)); err != nil {
+			t.Fatal(err)
+		} else if got != m.Recognizes([]byte(s)) {
+			t.Errorf("Disagreement about %q", s)
+		}
+	}
+
+	for _, prefix := range []string{"", "A", "BC", "DEF", "X"} {
+		want := TestStrings{}
+		for s := range m.PrefixSequences([]byte(prefix)) {
+			want = append(want, string(s))
+		}
+		got, err := r.PrefixSequences([]byte(prefix), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprintf("%s", got) != fmt.Sprint(want) {
+			t.Errorf("PrefixSequences(%q): got %d values, expected %d", prefix, len(got), len(want))
+		}
+		if limited, _ := r.PrefixSequences([]byte(prefix), 5); len(want) >= 5 && len(limited) != 5 {
+			t.Errorf("PrefixSequences(%q, 5): got %d values", prefix, len(limited))
+		}
+	}
+
+	if _, err := OpenReaderAt(bytes.NewReader(buffer.Bytes()), 20); err == nil {
+		t.Errorf("Expected an error for a truncated machine")
+	}
+}
+
+func TestStandardInterfaces(t *testing.T) {
+	var _ io.WriterTo = Recognizer{}
+	var _ io.ReaderFrom = &Recognizer{}
+	var _ encoding.BinaryMarshaler = Recognizer{}
+	var _ encoding.BinaryUnmarshaler = &Recognizer{}
+	var _ gob.GobEncoder = Recognizer{}
+	var _ gob.GobDecoder = &Recognizer{}
+
+	m := FromChannel(AllStrings().ToChannel())
+
+	var buffer bytes.Buffer
+	written, err := m.WriteTo(&buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written != int64(buffer.Len()) {
+		t.Errorf("WriteTo reported %d bytes, but wrote %d", written, buffer.Len())
+	}
+	var read Recognizer
+	if n, err := read.ReadFrom(&buffer); err != nil {
+		t.Fatal(err)
+	} else if n != written {
+		t.Errorf("ReadFrom reported %d bytes, expected %d", n, written)
+	}
+	if read.String() != m.String() {
+		t.Errorf("ReadFrom produced a different machine")
+	}
+
+	data, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var unmarshaled Recognizer
+	if err := unmarshaled.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if unmarshaled.String() != m.String() {
+		t.Errorf("UnmarshalBinary produced a different machine")
+	}
+
+	type wrapper struct {
+		Name    string
+		Machine Recognizer
+	}
+	buffer.Reset()
+	if err := gob.NewEncoder(&buffer).Encode(wrapper{"test", m}); err != nil {
+		t.Fatal(err)
+	}
+	var decoded wrapper
+	if err := gob.NewDecoder(&buffer).Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Name != "test" || decoded.Machine.String() != m.String() {
+		t.Errorf("Gob round trip produced a different value")
+	}
+}
+
+func TestJSON(t *testing.T) {
+	m := FromChannel(AllStrings().ToChannel())
+	var buffer bytes.Buffer
+	if err := m.WriteJSON(&buffer); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadJSON(&buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.String() != m.String() {
+		t.Errorf("JSON round trip produced a different machine")
+	}
+
+	// Reordered machines have transitions to higher IDs, but no cycles.
+	buffer.Reset()
+	reordered := m.Reorder(ByFrequency(AllStrings().ToChannel()))
+	reordered.WriteJSON(&buffer)
+	if read, err = ReadJSON(&buffer); err != nil || read.String() != reordered.String() {
+		t.Errorf("JSON round trip of a reordered machine failed: %v", err)
+	}
+
+	for _, bad := range []string{
+		`{"start": 0, "states": [[], []]}`,
+		`{"start": 1, "states": [[], [{"trigger": 65, "to": 2}]]}`,
+		`{"start": 1, "states": [[], [{"trigger": 65, "to": 0}, {"trigger": 65, "to": 0, "terminal": true}]]}`,
+		`{"start": 1, "states": [[], [{"trigger": 65, "to": 1, "terminal": true}]]}`,
+		`{"start": 2, "states": [[{"trigger": 66, "to": 1}], [{"trigger": 65, "to": 0, "terminal": true}], [{"trigger": 65, "to": 1}]]}`,
+	} {
+		if _, err := ReadJSON(bytes.NewBufferString(bad)); err == nil {
+			t.Errorf("Expected an error reading %s", bad)
+		}
+	}
+}
+
+func TestWriteDOT(t *testing.T) {
+	m := FromChannel(TestStrings{"A", "AB"}.ToChannel())
+	var buffer bytes.Buffer
+	if err := m.WriteDOT(&buffer, DOTOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	want := `digraph "mealy" {
+	node [shape=circle];
+	2 [label="2", shape=doublecircle];
+	1 [label="1"];
+	0 [label="0"];
+	2 -> 1 [label="A", color=red, fontcolor=red, style=bold];
+	1 -> 0 [label="B", color=red, fontcolor=red, style=bold];
+}
+`
+	if got := buffer.String(); got != want {
+		t.Errorf("Expected\n%s\ngot\n%s", want, got)
+	}
+}
+
+func TestFromReader(t *testing.T) {
+	keys := TestStrings{"A\n", "A\nB", "B\x00C", "\xff\xfe"}
+	var lines, nul, uvarint, hexLines, base64Lines bytes.Buffer
+	for _, k := range []string{"A", "AA", "AB"} {
+		fmt.Fprintf(&lines, "%s\r\n", k)
+	}
+	lines.WriteString("B")
+	for _, k := range []string{"A", "AA", "AB", "B"} {
+		fmt.Fprintf(&nul, "%s\x00", k)
+	}
+	buf := make([]byte, binary.MaxVarintLen64)
+	for _, k := range keys {
+		uvarint.Write(buf[:binary.PutUvarint(buf, uint64(len(k)))])
+		uvarint.WriteString(k)
+		fmt.Fprintf(&hexLines, "%x\n", k)
+		fmt.Fprintf(&base64Lines, "%s\n", base64.StdEncoding.EncodeToString([]byte(k)))
+	}
+
+	var gzipped bytes.Buffer
+	zw := gzip.NewWriter(&gzipped)
+	zw.Write(hexLines.Bytes())
+	zw.Close()
+
+	tests := []struct {
+		format KeyFormat
+		input  []byte
+		want   TestStrings
+	}{
+		{KeysLines, lines.Bytes(), TestStrings{"A", "AA", "AB", "B"}},
+		{KeysNUL, nul.Bytes(), TestStrings{"A", "AA", "AB", "B"}},
+		{KeysUvarint, uvarint.Bytes(), keys},
+		{KeysHex, hexLines.Bytes(), keys},
+		{KeysBase64, base64Lines.Bytes(), keys},
+		{KeysHex, gzipped.Bytes(), keys},
+	}
+	for _, test := range tests {
+		m, err := FromReader(bytes.NewReader(test.input), test.format)
+		if err != nil {
+			t.Errorf("%v: %v", test.format, err)
+			continue
+		}
+		if err := EqualChannels(t, test.want.ToChannel(), m.AllSequences()); err != nil {
+			t.Errorf("%v: %v", test.format, err)
+		}
+	}
+
+	for _, bad := range []struct {
+		format KeyFormat
+		input  string
+	}{
+		{KeysLines, "B\nA\n"},
+		{KeysHex, "zz\n"},
+		{KeysBase64, "!!!!\n"},
+		{KeysUvarint, "\x05AB"},
+	} {
+		if _, err := FromReader(bytes.NewBufferString(bad.input), bad.format); err == nil {
+			t.Errorf("%v: expected an error reading %q", bad.format, bad.input)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	m := FromChannel(AllStrings().ToChannel())
+	stats := m.Stats()
+	if stats.States != len(m) || stats.TotalTransitions != m.TotalTransitions() || stats.MaxFanout != m.MaxStateTransitions() {
+		t.Errorf("Stats disagree with the machine: %+v", stats)
+	}
+	if stats.Words != int64(len(AllStrings())) {
+		t.Errorf("Expected %d words, got %d", len(AllStrings()), stats.Words)
+	}
+	inputBytes := int64(0)
+	longest := ""
+	for _, s := range AllStrings() {
+		inputBytes += int64(len(s)) + 1
+		if len(s) > len(longest) {
+			longest = s
+		}
+	}
+	if stats.InputBytes != inputBytes || stats.LongestWord != longest {
+		t.Errorf("Expected %d input bytes and longest word %q, got %d and %q",
+			inputBytes, longest, stats.InputBytes, stats.LongestWord)
+	}
+	states := 0
+	for n, count := range stats.FanoutHistogram {
+		states += count
+		if n > stats.MaxFanout {
+			t.Errorf("Fanout histogram has an entry for %d", n)
+		}
+	}
+	if states != len(m) {
+		t.Errorf("Fanout histogram counts %d states, expected %d", states, len(m))
+	}
+	reached := 0
+	for _, count := range stats.DepthHistogram {
+		reached += count
+	}
+	if stats.DepthHistogram[0] != 1 || reached != len(m) {
+		t.Errorf("Unexpected depth histogram %v", stats.DepthHistogram)
+	}
+	var buffer bytes.Buffer
+	m.WriteTo(&buffer)
+	if stats.SerializedBytes["plain"] != int64(buffer.Len()) || stats.CompressionRatio <= 0 {
+		t.Errorf("Unexpected sizes %v, ratio %v", stats.SerializedBytes, stats.CompressionRatio)
+	}
+
+	if empty := (Recognizer{}).Stats(); empty.Words != 0 || empty.LongestWord != "" {
+		t.Errorf("Unexpected stats for an empty machine: %+v", empty)
+	}
+}
+
+func TestCompletionsAndCount(t *testing.T) {
+	m := FromChannel(AllStrings().ToChannel())
+	f := NewFlatRecognizer(m)
+	tests := []struct {
+		prefix string
+		limit  int
+		want   []string
+		count  int64
+	}{
+		{"", 0, AllStrings(), 9},
+		{"", 3, []string{"A", "AA", "AAA"}, 9},
+		{"AA", 0, []string{"AA", "AAA", "AAB"}, 3},
+		{"C", 1, []string{"CBA"}, 2},
+		{"DOBBER", 0, []string{"DOBBER"}, 1},
+		{"X", 0, []string{}, 0},
+	}
+	for _, test := range tests {
+		for _, got := range [][][]byte{m.Completions([]byte(test.prefix), test.limit), f.Completions([]byte(test.prefix), test.limit)} {
+			strs := []string{}
+			for _, g := range got {
+				strs = append(strs, string(g))
+			}
+			if !reflect.DeepEqual(strs, test.want) {
+				t.Errorf("Completions(%q, %d) = %q, want %q", test.prefix, test.limit, strs, test.want)
+			}
+		}
+		if got := m.CountSequences([]byte(test.prefix)); got != test.count {
+			t.Errorf("CountSequences(%q) = %d, want %d", test.prefix, got, test.count)
+		}
+		if got := f.CountSequences([]byte(test.prefix)); got != test.count {
+			t.Errorf("Flat CountSequences(%q) = %d, want %d", test.prefix, got, test.count)
+		}
+	}
+}
+
+func TestSuggest(t *testing.T) {
+	m := FromChannel(AllStrings().ToChannel())
+	tests := []struct {
+		value    string
+		maxEdits int
+		limit    int
+		want     []string
+	}{
+		{"CBA", 0, 0, []string{"CBA:0"}},
+		{"CBA", 1, 0, []string{"CBA:0", "CBB:1"}},
+		{"DIBBER", 1, 0, []string{"DABBER:1", "DOBBER:1"}},
+		{"AB", 1, 0, []string{"A:1", "AA:1", "AAB:1"}},
+		{"AB", 1, 2, []string{"A:1", "AA:1"}},
+		{"ZZZZ", 2, 0, []string{}},
+	}
+	for _, test := range tests {
+		got := []string{}
+		for _, s := range m.Suggest([]byte(test.value), test.maxEdits, test.limit) {
+			got = append(got, fmt.Sprintf("%s:%d", s.Value, s.Distance))
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Suggest(%q, %d, %d) = %q, want %q", test.value, test.maxEdits, test.limit, got, test.want)
+		}
+	}
+
+	// Compare with a direct computation of edit distance over random strings.
+	strings := RandomStrings(500, "ABCD", 7)
+	m = FromChannel(strings.ToChannel())
+	want := []string{}
+	for d := 0; d <= 2; d++ {
+		for _, s := range strings {
+			if levenshtein("ABCA", s) == d {
+				want = append(want, s)
+			}
+		}
+	}
+	got := []string{}
+	for _, s := range m.Suggest([]byte("ABCA"), 2, 0) {
+		got = append(got, string(s.Value))
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Suggest over random strings = %q, want %q", got, want)
+	}
+}
+
+func levenshtein(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		row := make([]int, len(b)+1)
+		row[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			row[j] = minInt(prev[j-1]+cost, minInt(prev[j]+1, row[j-1]+1))
+		}
+		prev = row
+	}
+	return prev[len(b)]
+}
+
+func TestHandle(t *testing.T) {
+	var empty Handle
+	count := 0
+	for range empty.AllSequences() {
+		count++
+	}
+	if empty.Recognizes([]byte("A")) || count != 0 {
+		t.Error("Zero Handle should recognize nothing")
+	}
+
+	a := FromChannel(AllStrings().ToChannel())
+	b := FromChannel(TestStrings{"X", "Y"}.ToChannel())
+	h := NewHandle(a)
+
+	// Query concurrently with swaps; run with -race to check for data races.
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if got := h.CountSequences(nil); got != 9 && got != 2 {
+					t.Errorf("Unexpected count %d", got)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		if i%2 == 0 {
+			h.Swap(b)
+		} else {
+			h.Swap(a)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	path := filepath.Join(t.TempDir(), "words.mealy")
+	if err := h.Load(path); err == nil {
+		t.Error("Expected an error loading a missing file")
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.WriteFormat(file, FormatVarint)
+	file.Close()
+
+	h.Swap(a)
+	reloaded := make(chan error, 1)
+	stopWatching := h.WatchFile(path, 10*time.Millisecond, func(err error) {
+		select {
+		case reloaded <- err:
+		default:
+		}
+	})
+	defer stopWatching()
+	// The file existed before watching began, so touch it to force a reload.
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Second))
+	select {
+	case err := <-reloaded:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Changed file was not reloaded")
+	}
+	if !h.Recognizes([]byte("X")) || h.Recognizes([]byte("A")) {
+		t.Error("Reloaded machine is not the one written")
+	}
+}
+
+func TestLayered(t *testing.T) {
+	strings := RandomStrings(2000, "ABCD", 3)
+	base := FromChannel(strings[:1000].ToChannel())
+	l := NewLayered(base)
+	expected := make(map[string]bool)
+	for _, s := range strings[:1000] {
+		expected[s] = true
+	}
+
+	r := rand.New(rand.NewSource(11))
+	for i := 0; i < 500; i++ {
+		s := strings[r.Intn(len(strings))]
+		if r.Intn(2) == 0 {
+			if got := l.Insert([]byte(s)); got == expected[s] {
+				t.Fatalf("Insert(%q) = %t with %q already present: %t", s, got, s, expected[s])
+			}
+			expected[s] = true
+		} else {
+			if got := l.Delete([]byte(s)); got != expected[s] {
+				t.Fatalf("Delete(%q) = %t with %q already present: %t", s, got, s, expected[s])
+			}
+			delete(expected, s)
+		}
+	}
+	if l.Insert([]byte{}) {
+		t.Error("Inserted an empty sequence")
+	}
+
+	remaining := TestStrings{}
+	for _, s := range strings {
+		if expected[s] {
+			remaining = append(remaining, s)
+		}
+		if l.Recognizes([]byte(s)) != expected[s] {
+			t.Errorf("Recognizes(%q) = %t, want %t", s, !expected[s], expected[s])
+		}
+	}
+	if err := EqualChannels(t, remaining.ToChannel(), l.AllSequences()); err != nil {
+		t.Error(err)
+	}
+	withPrefix := TestStrings{}
+	for _, s := range remaining {
+		if len(s) >= 2 && s[:2] == "BC" {
+			withPrefix = append(withPrefix, s)
+		}
+	}
+	if err := EqualChannels(t, withPrefix.ToChannel(), l.PrefixSequences([]byte("BC"))); err != nil {
+		t.Error(err)
+	}
+
+	compacted := l.Compact()
+	if inserted, deleted := l.Changes(); inserted != 0 || deleted != 0 {
+		t.Errorf("Layers not empty after compaction: %d, %d", inserted, deleted)
+	}
+	if built := FromChannel(remaining.ToChannel()); compacted.String() != built.String() {
+		t.Error("Compacted machine differs from one built from scratch")
+	}
+	if err := EqualChannels(t, remaining.ToChannel(), l.AllSequences()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenStore(dir, StoreOptions{Format: FormatVarint})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	strings := RandomStrings(3000, "ABCD", 5)
+	expected := make(map[string]bool)
+	r := rand.New(rand.NewSource(13))
+	for i := 0; i < 5; i++ {
+		b := &Batch{}
+		for j := 0; j < 300; j++ {
+			k := strings[r.Intn(len(strings))]
+			if r.Intn(3) == 0 {
+				b.Delete([]byte(k))
+				expected[k] = false
+			} else {
+				b.Insert([]byte(k))
+				expected[k] = true
+			}
+		}
+		if err := s.Write(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Write(&Batch{}); err != nil || s.Segments() != 5 {
+		t.Fatalf("Expected 5 segments, got %d (%v)", s.Segments(), err)
+	}
+
+	check := func(s *Store, when string) {
+		remaining := TestStrings{}
+		for _, k := range strings {
+			if expected[k] {
+				remaining = append(remaining, k)
+			}
+			if s.Recognizes([]byte(k)) != expected[k] {
+				t.Errorf("%s: Recognizes(%q) = %t, want %t", when, k, !expected[k], expected[k])
+			}
+		}
+		if err := EqualChannels(t, remaining.ToChannel(), s.AllSequences()); err != nil {
+			t.Errorf("%s: %v", when, err)
+		}
+		withPrefix := TestStrings{}
+		for _, k := range remaining {
+			if len(k) >= 2 && k[:2] == "DA" {
+				withPrefix = append(withPrefix, k)
+			}
+		}
+		if err := EqualChannels(t, withPrefix.ToChannel(), s.PrefixSequences([]byte("DA"))); err != nil {
+			t.Errorf("%s: %v", when, err)
+		}
+	}
+	check(s, "after writes")
+
+	// Files that are not in the manifest, as left by a crash, are ignored and
+	// removed on opening.
+	os.WriteFile(filepath.Join(dir, "99999999.keys.mealy"), []byte("junk"), 0644)
+	os.WriteFile(filepath.Join(dir, "MANIFEST.json.tmp123"), []byte("{"), 0644)
+	// Unrelated files are left alone.
+	for _, name := range []string{"english.mealy", "notes.tmpl", "1.keys.mealy"} {
+		os.WriteFile(filepath.Join(dir, name), []byte("keep"), 0644)
+	}
+	if s, err = OpenStore(dir, StoreOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	check(s, "after reopening")
+	if _, err := os.Stat(filepath.Join(dir, "99999999.keys.mealy")); !os.IsNotExist(err) {
+		t.Error("Unused segment was not removed")
+	}
+	for _, name := range []string{"english.mealy", "notes.tmpl", "1.keys.mealy"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("Unrelated file %s was removed", name)
+		}
+		os.Remove(filepath.Join(dir, name))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "MANIFEST.json.tmp123")); !os.IsNotExist(err) {
+		t.Error("Temporary manifest was not removed")
+	}
+
+	if err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if s.Segments() != 1 {
+		t.Errorf("Expected 1 segment after compaction, got %d", s.Segments())
+	}
+	check(s, "after compaction")
+	entries, _ := os.ReadDir(dir)
+	if files := s.Files(); len(entries) != len(files) {
+		t.Errorf("Expected only %q in the directory, found %d files", files, len(entries))
+	}
+	if s, err = OpenStore(dir, StoreOptions{CompactAt: 3}); err != nil {
+		t.Fatal(err)
+	}
+	check(s, "after reopening compacted")
+
+	// Background compaction keeps the number of segments down, while reads
+	// and writes continue.
+	for i := 0; i < 10; i++ {
+		b := &Batch{}
+		k := strings[i]
+		b.Insert([]byte(k))
+		expected[k] = true
+		if err := s.Write(b); err != nil {
+			t.Fatal(err)
+		}
+		check(s, "during background compaction")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	check(s, "after background compaction")
+	if s.Segments() >= 10 {
+		t.Errorf("Expected background compaction, found %d segments", s.Segments())
+	}
+}
+
+func TestStoreHoldsFullFanout(t *testing.T) {
+	s, err := OpenStore(t.TempDir(), StoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &Batch{}
+	for i := 0; i < 256; i++ {
+		b.Insert([]byte{byte(i), 'x'})
+	}
+	if err := s.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Recognizes([]byte{0xff, 'x'}) {
+		t.Errorf("Expected the store to hold every key")
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeyReaderRejectsHugeLengths(t *testing.T) {
+	for _, input := range []string{
+		"\xff\xff\xff\xff\xff\xff\xff\xff\xff\x01",
+		"\x80\x80\x80\x80\x01AB",
+	} {
+		kr, err := NewKeyReader(bytes.NewBufferString(input), KeysUvarint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := kr.Next(); err == nil || err == io.EOF {
+			t.Errorf("Expected an error reading length from %q, got %v", input, err)
+		}
+	}
+}
+
+func TestPlainFormatRejectsFullFanout(t *testing.T) {
+	keys := TestStrings{}
+	for b := 0; b < 256; b++ {
+		keys = append(keys, string([]byte{byte(b), 'x'}))
+	}
+	m := FromChannel(keys.ToChannel())
+	if err := m.WriteFormat(io.Discard, FormatPlain); err == nil {
+		t.Error("Expected an error writing a state with 256 transitions in the plain format")
+	}
+	for _, f := range []Format{FormatPacked, FormatVarint, FormatIndexed} {
+		var buffer bytes.Buffer
+		if err := m.WriteFormat(&buffer, f); err != nil {
+			t.Fatalf("%v: %v", f, err)
+		}
+		read, err := ReadFrom(&buffer)
+		if err != nil {
+			t.Fatalf("%v: %v", f, err)
+		}
+		if read.String() != m.String() {
+			t.Errorf("%v: round trip produced a different machine", f)
+		}
+	}
+}
+
+func TestReadRejectsImpossibleStateCounts(t *testing.T) {
+	for _, input := range []string{
+		varintPrefix + "\xff\xff\xff\xff\xff\xff\xff\xff\xff\x01",
+		varintPrefix + "\x80\x80\x80\x80\x01",
+		serializationPrefix + "\xff\xff\xff\xff",
+		serializationPrefix + "\x7f\xff\xff\xff",
+		packedPrefix + "\xff\xff\xff\xff" + string(make([]byte, 32)),
+		// Too many triggers, too many unique transitions, and a 33-bit field.
+		packedPrefix + "\x00\x00\x00\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00",
+		packedPrefix + "\x00\x00\x00\x02\x00\x01\x00\x00\x00\x05\x00\x00\x00\x00",
+		packedPrefix + "\x00\x00\x00\x02\x00\x01\x00\x00\x00\x01\x21\x00\x00\x00",
+	} {
+		if _, err := ReadFrom(bytes.NewBufferString(input)); err == nil {
+			t.Errorf("Expected an error reading %q", input)
+		}
+	}
+}
+
+func TestReadPackedRejectsMissingStates(t *testing.T) {
+	// Two states, with one transition on "A" from the start state to the
+	// final state, whose ID is written in 8 bits.
+	header := packedPrefix + "\x00\x00\x00\x02\x00\x01\x00\x00\x00\x01\x01\x00\x00\x08A"
+	m, err := ReadFrom(bytes.NewBufferString(header + "\x80\xa0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.Recognizes([]byte("A")) {
+		t.Errorf("Expected the machine to recognize \"A\"")
+	}
+	// The same, but pointing at state 127.
+	if _, err := ReadFrom(bytes.NewBufferString(header + "\xbf\xa0")); err == nil {
+		t.Errorf("Expected an error for a transition to a missing state")
+	}
+}
+
+func TestReadRejectsMissingStates(t *testing.T) {
+	m := FromChannel(TestStrings{"AB"}.ToChannel())
+	for _, format := range []Format{FormatPlain, FormatIndexed, FormatVarint} {
+		var buffer bytes.Buffer
+		if err := m.WriteFormat(&buffer, format); err != nil {
+			t.Fatal(err)
+		}
+		data := buffer.Bytes()
+		if format != FormatVarint {
+			// The last transition of the start state comes last; point it at
+			// state 127 of 3.
+			n := len(data)
+			data[n-3], data[n-2], data[n-1] = data[n-3]&0x80, 0, 0x7f
+		} else {
+			// Its delta-coded target comes last.
+			data[len(data)-1] = 0x7e
+		}
+		if _, err := ReadFrom(bytes.NewReader(data)); err == nil {
+			t.Errorf("Format %v: expected an error for a transition to a missing state", format)
+		}
+	}
+
+	var buffer bytes.Buffer
+	if err := m.WriteFormat(&buffer, FormatIndexed); err != nil {
+		t.Fatal(err)
+	}
+	data := buffer.Bytes()
+	// Claim that the start state ends far beyond the transitions.
+	binary.BigEndian.PutUint32(data[indexedHeaderSize+4*len(m):], 0xffffffff)
+	r, err := OpenReaderAt(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Recognizes([]byte("AB")); err == nil {
+		t.Errorf("Expected an error for corrupt offsets")
+	}
+}
+
+func TestReadIndexedRejectsImpossibleCounts(t *testing.T) {
+	for _, input := range []string{
+		indexedPrefix + "\xff\xff\xff\xff\x00\x00\x00\x00",
+		indexedPrefix + "\x00\x00\x00\x01\xff\xff\xff\xff",
+		// Counts that are possible, but more than the input holds.
+		indexedPrefix + "\x00\x10\x00\x00\x01\x00\x00\x00",
+	} {
+		if _, err := ReadFrom(bytes.NewBufferString(input)); err == nil {
+			t.Errorf("Expected an error reading %q", input)
+		}
+		if _, err := OpenReaderAt(bytes.NewReader([]byte(input)), int64(len(input))); err == nil {
+			t.Errorf("Expected an error opening %q", input)
+		}
+	}
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/shiblon/mealy"
+	"github.com/shiblon/mealy/mealyhttp"
+)
+
+// Compile a word list, verify it, print statistics, and write it out.
+func Build(args []string) {
+	flags := flag.NewFlagSet("build", flag.ExitOnError)
+	noWrite := flags.Bool("nowrite", false, "Set to just display stats.")
+	suffix := flags.Bool("suffix", false, "Also write a reversed machine to <out>.rev for suffix queries.")
+	substring := flags.Bool("substring", false, "Also write reversed and suffix machines to <out>.rev and <out>.sub for substring queries.")
+	workers := flags.Int("workers", 1, "Number of goroutines to build with, split by leading byte. Use 0 for one per CPU.")
+	maxMem := flags.Int("maxmem", 0, "Megabytes the registry of unique states may use while building, or 0 for no limit.")
+	reorder := flags.String("reorder", "none", "Renumber states before writing: none, bfs, or freq (by visits while recognizing the input).")
+	flags.BoolVar(&sortInput, "sort", false, "Sort and dedupe the input, so it need not be in order.")
+	flags.IntVar(&sortMem, "sortmem", 64, "Megabytes of input to sort in memory before spilling to temporary files.")
+	flags.StringVar(&format, "format", "plain", "Serialization format to write: plain, packed, varint, or indexed.")
+	AddInputFlags(flags)
+	flags.Parse(args)
+
+	inName := flags.Arg(0)
+	outName := flags.Arg(1)
+	if inName == "" || (outName == "" && !*noWrite) {
+		log.Fatal("build needs an input word list and an output file")
+	}
+
+	fmt.Printf("Reading file '%s'...\n", inName)
+	var machine mealy.Recognizer
+	buildOpts := mealy.BuildOptions{MaxRegistryBytes: int64(*maxMem) << 20}
+	if *workers == 1 {
+		builder := mealy.NewBuilder(buildOpts)
+		for value := range ByteFromStringChannel(InputChannel(inName)) {
+			if err := builder.Add(value); err != nil {
+				log.Fatal(err)
+			}
+		}
+		var err error
+		if machine, err = builder.Finish(); err != nil {
+			log.Fatal(err)
+		}
+		stats := builder.Stats()
+		fmt.Printf("  Built from %d values, peak registry size %d bytes\n", stats.Values, stats.PeakRegistryBytes)
+	} else {
+		var err error
+		machine, err = mealy.FromChannelParallel(ByteFromStringChannel(InputChannel(inName)), *workers, buildOpts)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	fmt.Print("Comparing sources for equivalence...")
+	equal, err := AreChannelsEqual(
+		InputChannel(inName),
+		StringFromByteChannel(machine.AllSequences()))
+
+	switch {
+	case equal:
+		fmt.Println("  EQUAL")
+	default:
+		fmt.Println("\n  NOT EQUAL:\n  ", err)
+		log.Fatal(err)
+	}
+
+	PrintStats(machine, false)
+
+	switch *reorder {
+	case "none":
+	case "bfs":
+		fmt.Println("Reordering states breadth-first...")
+		machine = machine.Reorder(mealy.BreadthFirst())
+	case "freq":
+		fmt.Println("Reordering states by visit frequency...")
+		machine = machine.Reorder(mealy.ByFrequency(ByteFromStringChannel(InputChannel(inName))))
+	default:
+		log.Fatalf("Unknown reorder strategy %q", *reorder)
+	}
+
+	if *noWrite {
+		fmt.Println("Not writing because of flag.")
+		return
+	}
+
+	fmt.Printf("Writing serialized machine to '%s'...\n", outName)
+	WriteMealy(outName, machine)
+
+	fmt.Printf("Reading serialized machine from '%s'...\n", outName)
+	writtenMachine := ReadMealy(outName)
+
+	fmt.Print("Comparing built machine to deserialized version...")
+	equal, err = AreChannelsEqual(
+		StringFromByteChannel(machine.AllSequences()),
+		StringFromByteChannel(writtenMachine.AllSequences()))
+	switch {
+	case equal:
+		fmt.Println("  EQUAL")
+	default:
+		fmt.Println("  NOT EQUAL:\n  ", err)
+		log.Fatal(err)
+	}
+
+	sortOpts := mealy.SortOptions{MemoryBudget: sortMem << 20}
+	if *suffix || *substring {
+		fmt.Printf("Writing reversed machine to '%s.rev'...\n", outName)
+		reversed, err := machine.ReversedWith(sortOpts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		WriteMealy(outName+".rev", reversed)
+	}
+	if *substring {
+		fmt.Printf("Writing suffix machine to '%s.sub'...\n", outName)
+		suffixes, err := machine.AllSuffixesWith(sortOpts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		WriteMealy(outName+".sub", suffixes)
+	}
+}
+
+// Print statistics for a machine, either readably or as JSON.
+func PrintStats(machine mealy.Recognizer, asJSON bool) {
+	stats := machine.Stats()
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(stats); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	fmt.Println("Statistics for compiled machine:")
+	fmt.Printf("  Number of states: %d (%x) (%d bits)\n", stats.States, stats.States, BitsNeeded(stats.States))
+	fmt.Printf("  Number of unique transitions: %d (%x) (%d bits)\n", stats.UniqueTransitions, stats.UniqueTransitions, BitsNeeded(stats.UniqueTransitions))
+	fmt.Printf("  Total transitions: %d\n", stats.TotalTransitions)
+	fmt.Printf("  Max transitions per state: %d (%x) (%d bits)\n", stats.MaxFanout, stats.MaxFanout, BitsNeeded(stats.MaxFanout))
+	fmt.Printf("  Number of trigger values: %d (%x) (%d bits)\n", len(stats.Triggers), len(stats.Triggers), BitsNeeded(len(stats.Triggers)))
+	fmt.Printf("  Number of words: %d\n", stats.Words)
+	fmt.Printf("  Longest word: %q (%d bytes)\n", stats.LongestWord, len(stats.LongestWord))
+	fmt.Printf("  Input size: %d bytes\n", stats.InputBytes)
+	fmt.Printf("  Estimated memory size: %d bytes\n", stats.MemoryBytes)
+	names := make([]string, 0, len(stats.SerializedBytes))
+	for name := range stats.SerializedBytes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("  Serialized size (%s): %d bytes\n", name, stats.SerializedBytes[name])
+	}
+	fmt.Printf("  Compression ratio: %.2f\n", stats.CompressionRatio)
+
+	fmt.Println("  Fanout histogram:")
+	for n, count := range stats.FanoutHistogram {
+		if count > 0 {
+			fmt.Printf("    %3d: %d\n", n, count)
+		}
+	}
+	fmt.Println("  States by depth:")
+	for d, count := range stats.DepthHistogram {
+		fmt.Printf("    %3d: %d\n", d, count)
+	}
+	fmt.Println("  Triggers:")
+	for _, trigger := range stats.Triggers {
+		fmt.Printf("    %08x\n", trigger)
+	}
+}
+
+// Print statistics for a compiled machine.
+func Stats(args []string) {
+	flags := flag.NewFlagSet("stats", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "Print statistics as JSON.")
+	flags.Parse(args)
+	PrintStats(ReadMealy(flags.Arg(0)), *asJSON)
+}
+
+// Check whether words are recognized, printing each with the result. Exits
+// with status 1 if any word is not recognized.
+func Lookup(args []string) {
+	flags := flag.NewFlagSet("lookup", flag.ExitOnError)
+	AddNormalizeFlags(flags)
+	flags.Parse(args)
+
+	machine := ReadMealy(flags.Arg(0))
+	words := make(chan string)
+	go func() {
+		defer close(words)
+		if flags.NArg() > 1 {
+			for _, w := range flags.Args()[1:] {
+				words <- w
+			}
+			return
+		}
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			words <- scanner.Text()
+		}
+		if err := scanner.Err(); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	missing := false
+	for w := range words {
+		key, keep := Normalize(w)
+		found := keep && machine.Recognizes([]byte(key))
+		missing = missing || !found
+		fmt.Printf("%s\t%t\n", w, found)
+	}
+	if missing {
+		os.Exit(1)
+	}
+}
+
+// Print the words that begin with a prefix.
+func Complete(args []string) {
+	flags := flag.NewFlagSet("complete", flag.ExitOnError)
+	AddNormalizeFlags(flags)
+	limit := flags.Int("limit", 0, "Maximum number of completions to print, or 0 for all.")
+	flags.Parse(args)
+
+	machine := ReadMealy(flags.Arg(0))
+	key, keep := Normalize(flags.Arg(1))
+	if !keep {
+		return
+	}
+	prefix := []byte(key)
+	if *limit <= 0 {
+		// Stream them, rather than holding every completion at once.
+		for word := range machine.PrefixSequences(prefix) {
+			fmt.Printf("%s\n", word)
+		}
+		return
+	}
+	for _, word := range machine.Completions(prefix, *limit) {
+		fmt.Printf("%s\n", word)
+	}
+}
+
+// Compare a compiled machine with a word list, exiting with status 1 if they
+// differ.
+func Verify(args []string) {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	flags.BoolVar(&sortInput, "sort", false, "Sort and dedupe the word list before comparing.")
+	flags.IntVar(&sortMem, "sortmem", 64, "Megabytes of input to sort in memory before spilling to temporary files.")
+	AddInputFlags(flags)
+	flags.Parse(args)
+
+	machine := ReadMealy(flags.Arg(0))
+	equal, err := AreChannelsEqual(
+		InputChannel(flags.Arg(1)),
+		StringFromByteChannel(machine.AllSequences()))
+	if !equal {
+		fmt.Println("NOT EQUAL:", err)
+		os.Exit(1)
+	}
+	fmt.Println("EQUAL")
+}
+
+// Print the words only in the first machine prefixed with "-", and those only
+// in the second prefixed with "+", in order.
+func Diff(args []string) {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	flags.Parse(args)
+
+	a, b := ReadMealy(flags.Arg(0)), ReadMealy(flags.Arg(1))
+	as, bs := a.AllSequences(), b.AllSequences()
+	av, aok := <-as
+	bv, bok := <-bs
+	for aok || bok {
+		switch c := bytes.Compare(av, bv); {
+		case aok && (!bok || c < 0):
+			fmt.Printf("-%s\n", av)
+			av, aok = <-as
+		case bok && (!aok || c > 0):
+			fmt.Printf("+%s\n", bv)
+			bv, bok = <-bs
+		default:
+			av, aok = <-as
+			bv, bok = <-bs
+		}
+	}
+}
+
+// Letters on a standard phone keypad, uppercase to match compiled input.
+var keypad = map[byte][]byte{
+	'2': []byte("ABC"),
+	'3': []byte("DEF"),
+	'4': []byte("GHI"),
+	'5': []byte("JKL"),
+	'6': []byte("MNO"),
+	'7': []byte("PQRS"),
+	'8': []byte("TUV"),
+	'9': []byte("WXYZ"),
+}
+
+// Print all words in the compiled machine that can be typed with each of the
+// given digit strings.
+func T9(args []string) {
+	flags := flag.NewFlagSet("t9", flag.ExitOnError)
+	flags.Parse(args)
+
+	machine := ReadMealy(flags.Arg(0))
+	for _, d := range flags.Args()[1:] {
+		fmt.Printf("%s:\n", d)
+		for word := range machine.MappedSequences([]byte(d), keypad) {
+			fmt.Printf("  %s\n", word)
+		}
+	}
+}
+
+// Print a compiled machine in a readable format.
+func Dump(args []string) {
+	flags := flag.NewFlagSet("dump", flag.ExitOnError)
+	dumpFormat := flags.String("format", "dot", "Output format: dot or json.")
+	maxStates := flags.Int("maxstates", 0, "Maximum number of states to render as DOT, or 0 for all.")
+	flags.Parse(args)
+
+	machine := ReadMealy(flags.Arg(0))
+	var err error
+	switch *dumpFormat {
+	case "dot":
+		err = machine.WriteDOT(os.Stdout, mealy.DOTOptions{MaxStates: *maxStates})
+	case "json":
+		err = machine.WriteJSON(os.Stdout)
+	default:
+		err = fmt.Errorf("unknown dump format %q", *dumpFormat)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Serve queries against a compiled machine over HTTP, reloading it whenever
+// the file changes or on SIGHUP.
+func Serve(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := flags.String("addr", ":8080", "Address to listen on.")
+	maxLimit := flags.Int("maxlimit", 1000, "Largest number of results a request may ask for, or 0 for no maximum.")
+	reload := flags.Duration("reload", 5*time.Second, "How often to check the machine file for changes, or 0 to never reload.")
+	AddNormalizeFlags(flags)
+	flags.Parse(args)
+
+	inName := flags.Arg(0)
+	normalize, err := normOptions.QueryNormalizer()
+	if err != nil {
+		log.Fatal(err)
+	}
+	handler := mealyhttp.NewHandler(ReadMealy(inName), mealyhttp.Options{
+		Normalize: normalize,
+		MaxLimit:  *maxLimit,
+	})
+	if *reload > 0 {
+		defer handler.WatchFile(inName, *reload)()
+	}
+	defer handler.Handle().ReloadOnSignal(inName, func(err error) {
+		if err != nil {
+			log.Printf("Reloading %s: %v", inName, err)
+			return
+		}
+		log.Printf("Reloaded %s", inName)
+	}, syscall.SIGHUP)()
+	log.Printf("Serving '%s' on %s", inName, *addr)
+	log.Fatal(http.ListenAndServe(*addr, handler))
+}
@@ -1,27 +1,70 @@
 package main
 
 import (
-	"bufio"
 	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"log"
 	"os"
-	"strings"
+	"sort"
 
 	"github.com/shiblon/mealy"
+	"github.com/shiblon/mealy/mealynorm"
 )
 
 var (
-	noWrite bool
+	sortInput   bool
+	sortMem     int
+	format      string
+	inputFormat string
+	normOptions mealynorm.Options
 )
 
-func init() {
-	flag.BoolVar(&noWrite, "nowrite", false, "Set to just display stats.")
+// Register the flags that control how keys are read from input files.
+func AddInputFlags(flags *flag.FlagSet) {
+	flags.StringVar(&inputFormat, "input", "lines", "Input key format: lines, nul, uvarint, hex, or base64. Gzip-compressed input is detected automatically.")
+	AddNormalizeFlags(flags)
 }
 
-func TextFileToChannel(inName string) <-chan string {
+// Register the flags that control how input lines are normalized. The
+// defaults match the original behavior of upper-casing and trimming each line,
+// and also skip blank lines, which cannot be compiled. Only keys read as lines
+// are normalized.
+func AddNormalizeFlags(flags *flag.FlagSet) {
+	flags.StringVar(&normOptions.Case, "case", "upper", "Case folding: none, upper, lower, or fold (Unicode case folding).")
+	flags.StringVar(&normOptions.Unicode, "unicode", "none", "Unicode normalization: none, nfc, or nfd.")
+	flags.BoolVar(&normOptions.Trim, "trim", true, "Trim leading and trailing white space.")
+	flags.BoolVar(&normOptions.SkipBlank, "skipblank", true, "Skip blank lines.")
+	flags.StringVar(&normOptions.CommentPrefix, "comment", "", "Skip lines beginning with this prefix, e.g. \"#\".")
+	flags.IntVar(&normOptions.Field, "field", 0, "Use only this field (counting from 1) of each line, or 0 for the whole line.")
+	flags.StringVar(&normOptions.FieldFormat, "fieldformat", "tsv", "How fields are separated: tsv or csv.")
+}
+
+// Return the normalizer for input lines, as configured by flags.
+func LineNormalizer() mealynorm.Normalizer {
+	n, err := normOptions.Normalizer()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return n
+}
+
+// Apply the normalization for individual words, as configured by flags, so
+// that lookups match what was compiled. Returns false if the normalizer skips
+// the word, in which case nothing can match it.
+func Normalize(word string) (string, bool) {
+	n, err := normOptions.QueryNormalizer()
+	if err != nil {
+		log.Fatal(err)
+	}
+	key, keep := n([]byte(word))
+	return string(key), keep
+}
+
+// Read keys from a file in the format given by flag, which may be compressed
+// with gzip. Lines of text go through the normalizer; keys in other formats are
+// used exactly as decoded. Empty keys are skipped.
+func KeyFileToChannel(inName string) <-chan string {
 	words := make(chan string)
 	go func() {
 		defer close(words)
@@ -32,12 +75,25 @@ func TextFileToChannel(inName string) <-chan string {
 		}
 		defer file.Close()
 
-		r := bufio.NewReader(file)
-		line, err := r.ReadString('\n')
-		for ; err == nil; line, err = r.ReadString('\n') {
-			words <- strings.TrimSpace(strings.ToUpper(line))
+		f, err := mealy.ParseKeyFormat(inputFormat)
+		if err != nil {
+			log.Fatal(err)
 		}
-		if err != io.EOF {
+		kr, err := mealy.NewKeyReader(file, f)
+		if err != nil {
+			log.Fatal(err)
+		}
+		normalize := mealynorm.Normalizer(mealynorm.Identity)
+		if f == mealy.KeysLines {
+			normalize = LineNormalizer()
+		}
+		for key := range kr.Keys() {
+			// Empty keys cannot be compiled, as with mealy.FromReader.
+			if key, keep := normalize(key); keep && len(key) > 0 {
+				words <- string(key)
+			}
+		}
+		if err := kr.Err(); err != nil {
 			log.Fatal(err)
 		}
 	}()
@@ -50,7 +106,11 @@ func WriteMealy(outName string, m mealy.Recognizer) {
 		log.Fatal(err)
 	}
 	defer file.Close()
-	err = m.WriteTo(file)
+	f, err := mealy.ParseFormat(format)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = m.WriteFormat(file, f)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -88,6 +148,40 @@ func AreChannelsEqual(a, b <-chan string) (bool, error) {
 	return true, nil
 }
 
+// Sort and dedupe the source channel, skipping empty values.
+func SortedStringChannel(source <-chan string) <-chan string {
+	sorter := mealy.NewSorter(mealy.SortOptions{MemoryBudget: sortMem << 20})
+	for x := range source {
+		if x != "" {
+			if err := sorter.Add([]byte(x)); err != nil {
+				// log.Fatal skips deferred calls, so clean up first.
+				sorter.Close()
+				log.Fatal(err)
+			}
+		}
+	}
+	out := make(chan string)
+	go func() {
+		defer close(out)
+		defer sorter.Close()
+		for x := range sorter.Sorted() {
+			out <- string(x)
+		}
+		if err := sorter.Err(); err != nil {
+			log.Fatal(err)
+		}
+	}()
+	return out
+}
+
+// Read the input file, sorted if requested by flag.
+func InputChannel(inName string) <-chan string {
+	if sortInput {
+		return SortedStringChannel(KeyFileToChannel(inName))
+	}
+	return KeyFileToChannel(inName)
+}
+
 func ByteFromStringChannel(source <-chan string) <-chan []byte {
 	out := make(chan []byte)
 	go func() {
@@ -118,64 +212,47 @@ func BitsNeeded(val int) int {
 	return needed
 }
 
-func main() {
-	flag.Parse()
-
-	inName := flag.Arg(0)
-	outName := flag.Arg(1)
-
-	fmt.Printf("Reading file '%s'...\n", inName)
-	machine := mealy.FromChannel(
-		ByteFromStringChannel(TextFileToChannel(inName)))
+// A subcommand, which parses its own flags from args.
+type command struct {
+	run   func(args []string)
+	usage string
+}
 
-	fmt.Print("Comparing sources for equivalence...")
-	equal, err := AreChannelsEqual(
-		TextFileToChannel(inName),
-		StringFromByteChannel(machine.AllSequences()))
+var commands = map[string]command{
+	"build":    {Build, "[flags] <words.txt> <out.mealy>: compile a word list"},
+	"lookup":   {Lookup, "[flags] <in.mealy> [words...]: check words given as arguments, or one per line on stdin"},
+	"complete": {Complete, "[-limit n] [flags] <in.mealy> <prefix>: list words beginning with prefix"},
+	"dump":     {Dump, "[-format dot|json] <in.mealy>: print the machine"},
+	"stats":    {Stats, "[-json] <in.mealy>: print statistics for a compiled machine"},
+	"verify":   {Verify, "[-sort] [flags] <in.mealy> <words.txt>: check that a machine matches a word list"},
+	"diff":     {Diff, "<a.mealy> <b.mealy>: list words added (+) and removed (-) going from a to b"},
+	"serve":    {Serve, "[-addr host:port] [flags] <in.mealy>: answer queries over HTTP"},
+	"t9":       {T9, "<in.mealy> [digits...]: list words typed by keypad digits"},
+}
 
-	switch {
-	case equal:
-		fmt.Println("  EQUAL")
-	default:
-		fmt.Println("\n  NOT EQUAL:\n  ", err)
-		log.Fatal(err)
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [arguments]\n\nCommands:\n", os.Args[0])
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
 	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s %s\n", name, commands[name].usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nWith no command, arguments are passed to build.\n")
+}
 
-	fmt.Println("Statistics for compiled machine:")
-	fmt.Printf("  Number of states: %d (%x) (%d bits)\n", len(machine), len(machine), BitsNeeded(len(machine)))
-	unique := machine.UniqueTransitions()
-	fmt.Printf("  Number of unique transitions: %d (%x) (%d bits)\n", unique, unique, BitsNeeded(unique))
-	numTransitions := machine.TotalTransitions()
-	fmt.Printf("  Total transitions: %d\n", numTransitions)
-	maxTransitions := machine.MaxStateTransitions()
-	fmt.Printf("  Max transitions per state: %d (%x) (%d bits)\n", maxTransitions, maxTransitions, BitsNeeded(maxTransitions))
-	allTriggers := machine.AllTriggers()
-	fmt.Printf("  Number of trigger values: %d (%x) (%d bits)\n", len(allTriggers), len(allTriggers), BitsNeeded(len(allTriggers)))
-
-	fmt.Println("  Triggers:")
-	for _, trigger := range allTriggers {
-		fmt.Printf("    %08x\n", trigger)
-	}
-
-	if noWrite {
-		fmt.Println("Not writing because of flag.")
-	} else {
-		fmt.Printf("Writing serialized machine to '%s'...\n", outName)
-		WriteMealy(outName, machine)
-
-		fmt.Printf("Reading serialized mcahine from '%s'...\n", outName)
-		writtenMachine := ReadMealy(outName)
-
-		fmt.Print("Comparing built machine to deserialized version...")
-		equal, err = AreChannelsEqual(
-			StringFromByteChannel(machine.AllSequences()),
-			StringFromByteChannel(writtenMachine.AllSequences()))
-		switch {
-		case equal:
-			fmt.Println("  EQUAL")
-		default:
-			fmt.Println("  NOT EQUAL:\n  ", err)
-			log.Fatal(err)
-		}
+func main() {
+	args := os.Args[1:]
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "-help" {
+		usage()
+		os.Exit(2)
+	}
+	if cmd, ok := commands[args[0]]; ok {
+		cmd.run(args[1:])
+		return
 	}
+	// Compatible with the original single-purpose invocation.
+	Build(args)
 }
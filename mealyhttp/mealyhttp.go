@@ -0,0 +1,235 @@
+/*
+Serves queries against a Mealy machine over HTTP, answering with JSON.
+
+The Handler answers GET requests on these paths:
+
+	/contains?word=W                       {"word": W, "found": true}
+	/complete?prefix=P&limit=N             {"prefix": P, "words": [...]}
+	/suggest?word=W&distance=D&limit=N     {"word": W, "suggestions": [{"word": ..., "distance": ...}]}
+	/count?prefix=P                        {"prefix": P, "count": N}
+
+Errors are reported with an appropriate status and {"error": message}.
+
+The machine can be replaced at any time with Swap, or reloaded from its file
+whenever it changes with WatchFile. Requests already in progress finish with the
+machine they started with.
+*/
+package mealyhttp
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/shiblon/mealy"
+	"github.com/shiblon/mealy/mealynorm"
+)
+
+// The number of results returned by /complete and /suggest when no limit is
+// given.
+const DefaultLimit = 10
+
+// The largest edit distance /suggest accepts, since the search grows quickly
+// with distance.
+const MaxDistance = 3
+
+// Options for a Handler.
+type Options struct {
+	// Applied to words and prefixes before they are looked up, so that they
+	// match the normalization the machine was compiled with. If nil, queries
+	// are used as given.
+	Normalize mealynorm.Normalizer
+	// The largest limit a request may ask for. Zero means no maximum.
+	MaxLimit int
+}
+
+// An http.Handler answering queries against a machine that can be swapped out
+// while serving.
+type Handler struct {
+	opts   Options
+	handle *mealy.Handle
+	mux    *http.ServeMux
+}
+
+// Create a Handler serving queries against m.
+func NewHandler(m mealy.Recognizer, opts Options) *Handler {
+	return NewHandlerFor(mealy.NewHandle(m), opts)
+}
+
+// Create a Handler serving queries against whatever machine handle holds, so
+// that it can be shared with other users of the machine.
+func NewHandlerFor(handle *mealy.Handle, opts Options) *Handler {
+	if opts.Normalize == nil {
+		opts.Normalize = mealynorm.Identity
+	}
+	h := &Handler{opts: opts, handle: handle, mux: http.NewServeMux()}
+	h.mux.HandleFunc("/contains", h.contains)
+	h.mux.HandleFunc("/complete", h.complete)
+	h.mux.HandleFunc("/suggest", h.suggest)
+	h.mux.HandleFunc("/count", h.count)
+	return h
+}
+
+// Return the Handle holding the machine being served.
+func (h *Handler) Handle() *mealy.Handle {
+	return h.handle
+}
+
+// Replace the machine being served. Requests in progress are unaffected.
+func (h *Handler) Swap(m mealy.Recognizer) {
+	h.handle.Swap(m)
+}
+
+// Return the machine currently being served.
+func (h *Handler) Recognizer() mealy.Recognizer {
+	return h.handle.Recognizer()
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	h.mux.ServeHTTP(w, r)
+}
+
+// Load the machine in path and swap it in. On error, the current machine is
+// kept.
+func (h *Handler) Load(path string) error {
+	return h.handle.Load(path)
+}
+
+// Check path every interval, and load it whenever it changes, as with
+// mealy.Handle.WatchFile. Reloads and errors are logged. Call the returned
+// function to stop watching.
+func (h *Handler) WatchFile(path string, interval time.Duration) (stop func()) {
+	return h.handle.WatchFile(path, interval, func(err error) {
+		if err != nil {
+			log.Printf("Reloading %s: %v", path, err)
+			return
+		}
+		log.Printf("Reloaded %s", path)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// Return the normalized value of the named query parameter, or an error if
+// the normalizer skips it.
+func (h *Handler) param(r *http.Request, name string) ([]byte, error) {
+	v := r.URL.Query().Get(name)
+	key, keep := h.opts.Normalize([]byte(v))
+	if !keep {
+		return nil, fmt.Errorf("invalid %s %q", name, v)
+	}
+	return key, nil
+}
+
+// Return the value of an integer query parameter, or def if it is missing.
+func intParam(r *http.Request, name string, def, min, max int) (int, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < min || (max > 0 && n > max) {
+		return 0, fmt.Errorf("invalid %s %q", name, v)
+	}
+	return n, nil
+}
+
+func (h *Handler) limit(r *http.Request) (int, error) {
+	limit, err := intParam(r, "limit", DefaultLimit, 1, h.opts.MaxLimit)
+	return limit, err
+}
+
+func stringsOf(values [][]byte) []string {
+	strs := make([]string, len(values))
+	for i, v := range values {
+		strs[i] = string(v)
+	}
+	return strs
+}
+
+func (h *Handler) contains(w http.ResponseWriter, r *http.Request) {
+	word, err := h.param(r, "word")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"word":  string(word),
+		"found": h.handle.Recognizes(word),
+	})
+}
+
+func (h *Handler) complete(w http.ResponseWriter, r *http.Request) {
+	limit, err := h.limit(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	prefix, err := h.param(r, "prefix")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"prefix": string(prefix),
+		"words":  stringsOf(h.handle.Completions(prefix, limit)),
+	})
+}
+
+type suggestion struct {
+	Word     string `json:"word"`
+	Distance int    `json:"distance"`
+}
+
+func (h *Handler) suggest(w http.ResponseWriter, r *http.Request) {
+	limit, err := h.limit(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	distance, err := intParam(r, "distance", 1, 0, MaxDistance)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	word, err := h.param(r, "word")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	suggestions := []suggestion{}
+	for _, s := range h.handle.Suggest(word, distance, limit) {
+		suggestions = append(suggestions, suggestion{string(s.Value), s.Distance})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"word":        string(word),
+		"suggestions": suggestions,
+	})
+}
+
+func (h *Handler) count(w http.ResponseWriter, r *http.Request) {
+	prefix, err := h.param(r, "prefix")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"prefix": string(prefix),
+		"count":  h.handle.CountSequences(prefix),
+	})
+}
@@ -0,0 +1,120 @@
+package mealyhttp
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/shiblon/mealy"
+	"github.com/shiblon/mealy/mealynorm"
+)
+
+func machine(words ...string) mealy.Recognizer {
+	values := make(chan []byte)
+	go func() {
+		defer close(values)
+		for _, w := range words {
+			values <- []byte(w)
+		}
+	}()
+	return mealy.FromChannel(values)
+}
+
+func get(t *testing.T, h http.Handler, url string, wantStatus int) map[string]interface{} {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+	if w.Code != wantStatus {
+		t.Fatalf("GET %s: status %d, want %d: %s", url, w.Code, wantStatus, w.Body)
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	return body
+}
+
+func TestHandler(t *testing.T) {
+	h := NewHandler(machine("A", "AA", "AAB", "BAA", "CBA", "CBB"), Options{Normalize: mealynorm.Upper})
+
+	tests := []struct {
+		url  string
+		key  string
+		want interface{}
+	}{
+		{"/contains?word=aa", "found", true},
+		{"/contains?word=ab", "found", false},
+		{"/complete?prefix=A", "words", []interface{}{"A", "AA", "AAB"}},
+		{"/complete?prefix=a&limit=2", "words", []interface{}{"A", "AA"}},
+		{"/complete?prefix=X", "words", []interface{}{}},
+		{"/count?prefix=", "count", 6.0},
+		{"/count?prefix=C", "count", 2.0},
+		{"/suggest?word=CBC", "suggestions", []interface{}{
+			map[string]interface{}{"word": "CBA", "distance": 1.0},
+			map[string]interface{}{"word": "CBB", "distance": 1.0},
+		}},
+		{"/suggest?word=CBC&distance=0", "suggestions", []interface{}{}},
+	}
+	for _, test := range tests {
+		body := get(t, h, test.url, http.StatusOK)
+		if got := body[test.key]; !reflect.DeepEqual(got, test.want) {
+			t.Errorf("GET %s: %s = %v, want %v", test.url, test.key, got, test.want)
+		}
+	}
+
+	for _, url := range []string{"/complete?limit=0", "/complete?limit=x", "/suggest?word=A&distance=9"} {
+		if body := get(t, h, url, http.StatusBadRequest); body["error"] == nil {
+			t.Errorf("GET %s: expected an error", url)
+		}
+	}
+
+	// Queries the normalizer skips are rejected, rather than looked up as
+	// empty keys.
+	skipping := NewHandler(machine("A", "AA"), Options{Normalize: mealynorm.Chain(mealynorm.SkipComments("#"), mealynorm.SkipBlank)})
+	for _, url := range []string{"/complete?prefix=%23x", "/count?prefix=", "/contains?word=%23A", "/suggest?word=%23A"} {
+		if body := get(t, skipping, url, http.StatusBadRequest); body["error"] == nil {
+			t.Errorf("GET %s: expected an error", url)
+		}
+	}
+
+	h.Swap(machine("Z"))
+	if body := get(t, h, "/contains?word=z", http.StatusOK); body["found"] != true {
+		t.Errorf("Swapped machine not used")
+	}
+}
+
+func TestWatchFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "words.mealy")
+	write := func(m mealy.Recognizer) {
+		file, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		if _, err := m.WriteTo(file); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(machine("A"))
+	h := NewHandler(nil, Options{})
+	if err := h.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	stop := h.WatchFile(path, 10*time.Millisecond)
+	defer stop()
+
+	write(machine("A", "B", "C"))
+	// Make sure the change is visible even on filesystems with coarse times.
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Second))
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if h.Recognizer().Recognizes([]byte("C")) {
+			return
+		}
+	}
+	t.Error("Changed file was not reloaded")
+}
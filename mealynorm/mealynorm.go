@@ -0,0 +1,190 @@
+/*
+Normalizes lines of input into keys for building Mealy machines, so that the
+same transformations can be applied to the words being looked up later.
+
+Normalizers are composed into a pipeline with Chain, or built from an Options
+value, which is convenient for command-line flags.
+*/
+package mealynorm
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Transforms a line of input into a key, or reports that the line should be
+// skipped entirely by returning false.
+type Normalizer func(line []byte) (key []byte, keep bool)
+
+// Return a Normalizer that applies each of the given steps in turn, stopping
+// as soon as one of them skips the line.
+func Chain(steps ...Normalizer) Normalizer {
+	return func(line []byte) ([]byte, bool) {
+		for _, step := range steps {
+			var keep bool
+			if line, keep = step(line); !keep {
+				return nil, false
+			}
+		}
+		return line, true
+	}
+}
+
+// Leave the line as it is.
+func Identity(line []byte) ([]byte, bool) {
+	return line, true
+}
+
+// Convert the line to upper case.
+func Upper(line []byte) ([]byte, bool) {
+	return bytes.ToUpper(line), true
+}
+
+// Convert the line to lower case.
+func Lower(line []byte) ([]byte, bool) {
+	return bytes.ToLower(line), true
+}
+
+// Apply Unicode case folding, which maps strings that differ only in case
+// (including special cases like "ß" and "SS") to the same value.
+func CaseFold(line []byte) ([]byte, bool) {
+	return cases.Fold().Bytes(line), true
+}
+
+// Remove leading and trailing white space.
+func TrimSpace(line []byte) ([]byte, bool) {
+	return bytes.TrimSpace(line), true
+}
+
+// Skip empty lines, which cannot be compiled.
+func SkipBlank(line []byte) ([]byte, bool) {
+	return line, len(line) > 0
+}
+
+// Convert the line to Unicode normalization form C (composed).
+func NFC(line []byte) ([]byte, bool) {
+	return norm.NFC.Bytes(line), true
+}
+
+// Convert the line to Unicode normalization form D (decomposed).
+func NFD(line []byte) ([]byte, bool) {
+	return norm.NFD.Bytes(line), true
+}
+
+// Return a Normalizer that skips lines starting with prefix, ignoring leading
+// white space.
+func SkipComments(prefix string) Normalizer {
+	return func(line []byte) ([]byte, bool) {
+		return line, !bytes.HasPrefix(bytes.TrimLeft(line, " \t"), []byte(prefix))
+	}
+}
+
+// Return a Normalizer that keeps only field n (counting from zero) of a line
+// split on sep. Lines with too few fields are skipped.
+func Field(sep byte, n int) Normalizer {
+	return func(line []byte) ([]byte, bool) {
+		fields := bytes.Split(line, []byte{sep})
+		if n >= len(fields) {
+			return nil, false
+		}
+		return fields[n], true
+	}
+}
+
+// Return a Normalizer that parses the line as a CSV record and keeps only
+// field n (counting from zero). Lines that are not valid CSV or have too few
+// fields are skipped.
+func CSVField(n int) Normalizer {
+	return func(line []byte) ([]byte, bool) {
+		r := csv.NewReader(bytes.NewReader(line))
+		r.FieldsPerRecord = -1
+		fields, err := r.Read()
+		if err != nil || n >= len(fields) {
+			return nil, false
+		}
+		return []byte(fields[n]), true
+	}
+}
+
+// A description of a normalization pipeline. The zero value leaves lines
+// unchanged.
+type Options struct {
+	// One of "", "none", "upper", "lower", or "fold".
+	Case string
+	// One of "", "none", "nfc", or "nfd".
+	Unicode string
+	// Remove leading and trailing white space.
+	Trim bool
+	// Skip lines that are empty after all other steps.
+	SkipBlank bool
+	// If not empty, skip lines starting with this prefix.
+	CommentPrefix string
+	// If positive, keep only this field of each line, counting from one.
+	Field int
+	// How fields are separated: "tsv" (the default) or "csv".
+	FieldFormat string
+}
+
+// Return the pipeline for these options, which handles comments, then fields,
+// then the steps of QueryNormalizer (white space, Unicode normalization, and
+// case), and finally blank lines.
+func (o Options) Normalizer() (Normalizer, error) {
+	steps := []Normalizer{}
+	if o.CommentPrefix != "" {
+		steps = append(steps, SkipComments(o.CommentPrefix))
+	}
+	if o.Field > 0 {
+		switch o.FieldFormat {
+		case "", "tsv":
+			steps = append(steps, Field('\t', o.Field-1))
+		case "csv":
+			steps = append(steps, CSVField(o.Field-1))
+		default:
+			return nil, fmt.Errorf("unknown field format %q", o.FieldFormat)
+		}
+	}
+	query, err := o.QueryNormalizer()
+	if err != nil {
+		return nil, err
+	}
+	steps = append(steps, query)
+	if o.SkipBlank {
+		steps = append(steps, SkipBlank)
+	}
+	return Chain(steps...), nil
+}
+
+// Return only the steps of the pipeline that transform a single key, which
+// should be applied to words before looking them up: white space trimming,
+// Unicode normalization, and case.
+func (o Options) QueryNormalizer() (Normalizer, error) {
+	steps := []Normalizer{}
+	if o.Trim {
+		steps = append(steps, TrimSpace)
+	}
+	switch o.Unicode {
+	case "", "none":
+	case "nfc":
+		steps = append(steps, NFC)
+	case "nfd":
+		steps = append(steps, NFD)
+	default:
+		return nil, fmt.Errorf("unknown Unicode normalization %q", o.Unicode)
+	}
+	switch o.Case {
+	case "", "none":
+	case "upper":
+		steps = append(steps, Upper)
+	case "lower":
+		steps = append(steps, Lower)
+	case "fold":
+		steps = append(steps, CaseFold)
+	default:
+		return nil, fmt.Errorf("unknown case folding %q", o.Case)
+	}
+	return Chain(steps...), nil
+}
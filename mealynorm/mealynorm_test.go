@@ -0,0 +1,75 @@
+package mealynorm
+
+import (
+	"testing"
+)
+
+func TestSteps(t *testing.T) {
+	tests := []struct {
+		name string
+		n    Normalizer
+		in   string
+		want string
+		keep bool
+	}{
+		{"upper", Upper, "abc", "ABC", true},
+		{"lower", Lower, "ABC", "abc", true},
+		{"fold", CaseFold, "Straße", "strasse", true},
+		{"trim", TrimSpace, " \tabc \r", "abc", true},
+		{"blank", SkipBlank, "", "", false},
+		{"nonblank", SkipBlank, "a", "a", true},
+		{"nfc", NFC, "é", "é", true},
+		{"nfd", NFD, "é", "é", true},
+		{"comment", SkipComments("#"), "  # note", "", false},
+		{"not comment", SkipComments("#"), "a#b", "a#b", true},
+		{"field", Field('\t', 1), "1\tword\tx", "word", true},
+		{"missing field", Field('\t', 3), "1\tword", "", false},
+		{"csv field", CSVField(1), `1,"a, b",c`, "a, b", true},
+		{"bad csv", CSVField(0), `"open`, "", false},
+	}
+	for _, test := range tests {
+		got, keep := test.n([]byte(test.in))
+		if keep != test.keep || (keep && string(got) != test.want) {
+			t.Errorf("%s(%q) = %q, %t; want %q, %t", test.name, test.in, got, keep, test.want, test.keep)
+		}
+	}
+}
+
+func TestOptions(t *testing.T) {
+	n, err := Options{
+		Case:          "lower",
+		Unicode:       "nfc",
+		Trim:          true,
+		SkipBlank:     true,
+		CommentPrefix: "#",
+		Field:         2,
+	}.Normalizer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := []string{"# header", "1\t  Café ", "2\t ", "3"}
+	got := []string{}
+	for _, line := range lines {
+		if key, keep := n([]byte(line)); keep {
+			got = append(got, string(key))
+		}
+	}
+	if len(got) != 1 || got[0] != "café" {
+		t.Errorf("Normalized %q to %q", lines, got)
+	}
+
+	if _, err := (Options{Case: "title"}).Normalizer(); err == nil {
+		t.Error("Expected an error for an unknown case option")
+	}
+	if _, err := (Options{Field: 1, FieldFormat: "xml"}).Normalizer(); err == nil {
+		t.Error("Expected an error for an unknown field format")
+	}
+
+	query, err := Options{Case: "upper", Trim: true, Field: 2}.QueryNormalizer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, keep := query([]byte(" abc\tdef ")); !keep || string(key) != "ABC\tDEF" {
+		t.Errorf("Query normalized to %q, %t", key, keep)
+	}
+}
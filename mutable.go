@@ -0,0 +1,196 @@
+package mealy
+
+// A machine that supports adding and removing sequences one at a time, while
+// staying minimal.
+//
+// Changes follow the incremental construction of Carrasco and Forcada: the
+// states along the path of the changed sequence are copied, modified, and
+// registered again from the bottom up, so that each one is merged with any
+// equivalent state that already exists. States that are no longer reachable
+// are left behind, and are periodically dropped by renumbering the machine.
+//
+// The registry of unique states that FromChannel uses during construction is
+// kept alongside the states, which is what allows this to work.
+type Mutable struct {
+	reg   *registry
+	start int
+	// Number of states after the last compaction.
+	live int
+	// The most states the registry may hold, which is maxStates except in
+	// tests.
+	capacity int
+}
+
+// Create a mutable machine containing all sequences recognized by m, which
+// must be minimal (as all machines built by this package are). The states of
+// m are shared, but never modified. Returns ErrTooManyStates if m has more
+// states than transitions can refer to.
+func NewMutable(m Recognizer) (*Mutable, error) {
+	if len(m) == 0 {
+		m = Recognizer{{}}
+	}
+	if len(m) > maxStates {
+		return nil, ErrTooManyStates
+	}
+	return &Mutable{
+		reg:      registryFor(m),
+		start:    m.StartId(),
+		live:     len(m),
+		capacity: maxStates,
+	}, nil
+}
+
+// Return true if key is recognized.
+func (m *Mutable) Recognizes(key []byte) bool {
+	id, terminal := m.start, false
+	for _, b := range key {
+		var ok bool
+		if id, terminal, ok = m.reg.states.Step(id, b); !ok {
+			return false
+		}
+	}
+	return terminal
+}
+
+// Add key to the recognized sequences. Returns false if key is empty, since
+// empty sequences cannot be represented, or if it is already recognized.
+// Returns ErrTooManyStates, and leaves the machine unchanged, if the result
+// would need more states than transitions can refer to.
+func (m *Mutable) Insert(key []byte) (bool, error) {
+	if len(key) == 0 || m.Recognizes(key) {
+		return false, nil
+	}
+	// The path is copied, and may end in a new final state.
+	if err := m.reserve(len(key) + 1); err != nil {
+		return false, err
+	}
+	m.start = m.insert(m.start, key)
+	m.maybeCompact()
+	return true, nil
+}
+
+// Remove key from the recognized sequences. Returns false if it was not there.
+// Returns ErrTooManyStates, as Insert does, since the states along the path
+// are copied.
+func (m *Mutable) Delete(key []byte) (bool, error) {
+	if !m.Recognizes(key) {
+		return false, nil
+	}
+	if err := m.reserve(len(key)); err != nil {
+		return false, err
+	}
+	m.start = m.delete(m.start, key)
+	m.maybeCompact()
+	return true, nil
+}
+
+// Return a copy of the state with the given ID, with room for one more
+// transition.
+func (m *Mutable) cloneState(id int) state {
+	old := m.reg.states[id]
+	s := make(state, len(old), len(old)+1)
+	copy(s, old)
+	return s
+}
+
+// Return the ID of a new state like the one given, but which also recognizes
+// key.
+func (m *Mutable) insert(id int, key []byte) int {
+	s := m.cloneState(id)
+	i := s.IndexForTrigger(key[0])
+
+	child, terminal := 0, false
+	if i < len(s) {
+		child, terminal = s[i].ToState(), s[i].IsTerminal()
+	} else {
+		child = m.reg.Register(state{})
+	}
+
+	if len(key) == 1 {
+		terminal = true
+	} else {
+		child = m.insert(child, key[1:])
+	}
+
+	if t := NewTransition(key[0], child, terminal); i < len(s) {
+		s[i] = t
+	} else {
+		s.AddTransition(t)
+	}
+	return m.reg.Register(s)
+}
+
+// Return the ID of a new state like the one given, but which does not
+// recognize key. The key must be recognized from the given state.
+func (m *Mutable) delete(id int, key []byte) int {
+	s := m.cloneState(id)
+	i := s.IndexForTrigger(key[0])
+	child, terminal := s[i].ToState(), s[i].IsTerminal()
+
+	if len(key) == 1 {
+		terminal = false
+	} else {
+		child = m.delete(child, key[1:])
+	}
+
+	if !terminal && m.reg.states[child].IsEmpty() {
+		// Nothing is reachable this way anymore.
+		s = append(s[:i], s[i+1:]...)
+	} else {
+		s[i] = NewTransition(key[0], child, terminal)
+	}
+	return m.reg.Register(s)
+}
+
+// Make sure that n more states can be registered without their IDs running
+// past the capacity, compacting first if that makes room.
+func (m *Mutable) reserve(n int) error {
+	if len(m.reg.states)+n <= m.capacity {
+		return nil
+	}
+	m.compact()
+	if len(m.reg.states)+n > m.capacity {
+		return ErrTooManyStates
+	}
+	return nil
+}
+
+// Drop unreachable states once they make up most of the machine.
+func (m *Mutable) maybeCompact() {
+	if len(m.reg.states) > 2*m.live+1024 {
+		m.compact()
+	}
+}
+
+// Renumber the machine, dropping unreachable states.
+func (m *Mutable) compact() {
+	compacted := m.Recognizer()
+	m.reg = registryFor(compacted)
+	m.start = compacted.StartId()
+	m.live = len(compacted)
+}
+
+// Return a Recognizer with the current contents of this machine. Only
+// reachable states are included, numbered so that every state comes after
+// the states it leads to, as in machines built by FromChannel.
+func (m *Mutable) Recognizer() Recognizer {
+	ids := make(map[int]int)
+	out := Recognizer{}
+
+	var visit func(id int) int
+	visit = func(id int) int {
+		if newId, ok := ids[id]; ok {
+			return newId
+		}
+		old := m.reg.states[id]
+		s := make(state, len(old))
+		for i, t := range old {
+			s[i] = NewTransition(t.Trigger(), visit(t.ToState()), t.IsTerminal())
+		}
+		ids[id] = len(out)
+		out = append(out, s)
+		return ids[id]
+	}
+	visit(m.start)
+	return out
+}
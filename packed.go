@@ -0,0 +1,251 @@
+package mealy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Must always be 6 bytes.
+const packedPrefix = "MMeMv2"
+
+// Return the number of bits needed to represent every value from 0 to max.
+func bitsNeeded(max int) uint {
+	needed := uint(0)
+	for ; max > 0; needed++ {
+		max >>= 1
+	}
+	return needed
+}
+
+// Writes values of arbitrary bit widths, most significant bit first.
+type bitWriter struct {
+	w   *bufio.Writer
+	acc uint64
+	n   uint
+}
+
+func (b *bitWriter) Write(value uint64, bits uint) error {
+	for bits > 0 {
+		take := bits
+		if take > 32 {
+			take = 32
+		}
+		bits -= take
+		b.acc = b.acc<<take | (value>>bits)&(1<<take-1)
+		for b.n += take; b.n >= 8; b.n -= 8 {
+			if err := b.w.WriteByte(byte(b.acc >> (b.n - 8))); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Write any remaining bits, padded with zeros to a whole byte.
+func (b *bitWriter) Flush() error {
+	if b.n > 0 {
+		if err := b.Write(0, 8-b.n); err != nil {
+			return err
+		}
+	}
+	return b.w.Flush()
+}
+
+// Reads values written by a bitWriter.
+type bitReader struct {
+	r   io.ByteReader
+	acc uint64
+	n   uint
+}
+
+func (b *bitReader) Read(bits uint) (uint64, error) {
+	value := uint64(0)
+	for bits > 0 {
+		if b.n == 0 {
+			c, err := b.r.ReadByte()
+			if err != nil {
+				return 0, err
+			}
+			b.acc, b.n = uint64(c), 8
+		}
+		take := bits
+		if take > b.n {
+			take = b.n
+		}
+		b.n -= take
+		bits -= take
+		value = value<<take | (b.acc>>b.n)&(1<<take-1)
+	}
+	return value, nil
+}
+
+// The header of a packed machine, which gives the sizes of everything.
+type packedHeader struct {
+	NumStates   uint32
+	NumTriggers uint16
+	NumUnique   uint32
+	FanoutBits  uint8
+	UniqueBits  uint8
+	TriggerBits uint8
+	ToStateBits uint8
+}
+
+// Return an error if the header describes a machine that cannot exist, so that
+// nothing is allocated for a corrupt one.
+func (h packedHeader) check() error {
+	if h.NumStates > maxStates {
+		return fmt.Errorf("state count %d exceeds the maximum of %d", h.NumStates, maxStates)
+	}
+	if h.NumTriggers > 256 {
+		return fmt.Errorf("trigger count %d exceeds the maximum of 256", h.NumTriggers)
+	}
+	// Each unique transition has a distinct trigger, terminal flag and target.
+	if uint64(h.NumUnique) > 2*uint64(h.NumTriggers)*uint64(h.NumStates) {
+		return fmt.Errorf("unique transition count %d is impossible for %d states", h.NumUnique, h.NumStates)
+	}
+	for _, bits := range []uint8{h.FanoutBits, h.UniqueBits, h.TriggerBits, h.ToStateBits} {
+		if bits > 32 {
+			return fmt.Errorf("field width of %d bits exceeds the maximum of 32", bits)
+		}
+	}
+	return nil
+}
+
+// Write a machine as a table of trigger values, a table of unique transitions
+// that refer to it, and a bit-packed record for each state giving its fanout
+// and the index of each of its transitions in the unique table. Every field is
+// given the fewest bits that can hold its largest value.
+func (self Recognizer) writePacked(w io.Writer) (err error) {
+	triggers := self.AllTriggers()
+	triggerIndex := make(map[byte]int)
+	for i, t := range triggers {
+		triggerIndex[t] = i
+	}
+
+	uniqueIndex := make(map[transition]int)
+	for _, s := range self {
+		for _, t := range s {
+			uniqueIndex[t] = 0
+		}
+	}
+	unique := make([]transition, 0, len(uniqueIndex))
+	for t := range uniqueIndex {
+		unique = append(unique, t)
+	}
+	sort.Slice(unique, func(i, j int) bool { return unique[i] < unique[j] })
+	for i, t := range unique {
+		uniqueIndex[t] = i
+	}
+
+	h := packedHeader{
+		NumStates:   uint32(len(self)),
+		NumTriggers: uint16(len(triggers)),
+		NumUnique:   uint32(len(unique)),
+		FanoutBits:  uint8(bitsNeeded(self.MaxStateTransitions())),
+		UniqueBits:  uint8(bitsNeeded(len(unique) - 1)),
+		TriggerBits: uint8(bitsNeeded(len(triggers) - 1)),
+		ToStateBits: uint8(bitsNeeded(len(self) - 1)),
+	}
+	if err = binary.Write(w, binary.BigEndian, h); err != nil {
+		return
+	}
+	if err = binary.Write(w, binary.BigEndian, triggers); err != nil {
+		return
+	}
+
+	bw := &bitWriter{w: bufio.NewWriter(w)}
+	for _, t := range unique {
+		terminal := uint64(0)
+		if t.IsTerminal() {
+			terminal = 1
+		}
+		if err = bw.Write(uint64(triggerIndex[t.Trigger()]), uint(h.TriggerBits)); err != nil {
+			return
+		}
+		if err = bw.Write(terminal, 1); err != nil {
+			return
+		}
+		if err = bw.Write(uint64(t.ToState()), uint(h.ToStateBits)); err != nil {
+			return
+		}
+	}
+	for _, s := range self {
+		if err = bw.Write(uint64(len(s)), uint(h.FanoutBits)); err != nil {
+			return
+		}
+		for _, t := range s {
+			if err = bw.Write(uint64(uniqueIndex[t]), uint(h.UniqueBits)); err != nil {
+				return
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+func readPacked(r io.Reader) (f FlatRecognizer, err error) {
+	var h packedHeader
+	if err = binary.Read(r, binary.BigEndian, &h); err != nil {
+		return
+	}
+	if err = h.check(); err != nil {
+		return
+	}
+	triggers := make([]byte, h.NumTriggers)
+	if _, err = io.ReadFull(r, triggers); err != nil {
+		return
+	}
+
+	br := &bitReader{r: byteReader(r)}
+	// Grow the table as it is read, so a truncated file fails before much is
+	// allocated.
+	unique := make([]transition, 0, minInt(int(h.NumUnique), 1<<16))
+	for i := 0; i < int(h.NumUnique); i++ {
+		var trigger, terminal, toState uint64
+		if trigger, err = br.Read(uint(h.TriggerBits)); err != nil {
+			return
+		}
+		if terminal, err = br.Read(1); err != nil {
+			return
+		}
+		if toState, err = br.Read(uint(h.ToStateBits)); err != nil {
+			return
+		}
+		if trigger >= uint64(len(triggers)) {
+			err = fmt.Errorf("trigger index %d out of range", trigger)
+			return
+		}
+		if toState >= uint64(h.NumStates) {
+			err = fmt.Errorf("transition %d points to missing state %d", i, toState)
+			return
+		}
+		unique = append(unique, NewTransition(triggers[trigger], int(toState), terminal == 1))
+	}
+
+	f.offsets = make([]uint32, 1, h.NumStates+1)
+	for i := 0; i < int(h.NumStates); i++ {
+		var fanout uint64
+		if fanout, err = br.Read(uint(h.FanoutBits)); err != nil {
+			return
+		}
+		if fanout > 256 {
+			err = fmt.Errorf("state %d has impossible fanout %d", i, fanout)
+			return
+		}
+		for j := 0; j < int(fanout); j++ {
+			var index uint64
+			if index, err = br.Read(uint(h.UniqueBits)); err != nil {
+				return
+			}
+			if index >= uint64(len(unique)) {
+				err = fmt.Errorf("transition index %d out of range", index)
+				return
+			}
+			f.transitions = append(f.transitions, unique[index])
+		}
+		f.offsets = append(f.offsets, uint32(len(f.transitions)))
+	}
+	return
+}
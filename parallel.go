@@ -0,0 +1,151 @@
+package mealy
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"sync/atomic"
+)
+
+// The result of building the values that share a leading byte.
+type shard struct {
+	values chan []byte
+	done   chan bool
+	states Recognizer
+	start  state
+	err    error
+}
+
+// Builds a new mealy machine from an ordered list of values, like a Builder,
+// but splits the values by their leading byte and builds each group on its own
+// goroutine, using at most the given number at once (or GOMAXPROCS if workers
+// is not positive).
+//
+// The groups are merged in order under a single registry, so that equivalent
+// states are shared across groups, and the result is identical to what
+// FromChannel would produce from the same values. Each group has its own
+// registry while it is built, so this uses more memory than FromChannel, and
+// it only helps when the values are spread over several leading bytes.
+//
+// Returns the same errors as Builder.Add and Builder.Finish. The memory
+// ceiling in opts applies to the registries of all groups together, and
+// separately to the merged registry. The channel is always drained, even if an
+// error occurs.
+func FromChannelParallel(values <-chan []byte, workers int, opts BuildOptions) (Recognizer, error) {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	sem := make(chan bool, workers)
+	shards := []*shard{}
+	// Estimated bytes used by the registries of all shards.
+	var total int64
+
+	build := func(sh *shard) {
+		sem <- true
+		defer func() { <-sem }()
+		defer close(sh.done)
+		b := NewBuilder(BuildOptions{})
+		counted := int64(0)
+		account := func() {
+			peak := b.reg.peakBytes
+			sum := atomic.AddInt64(&total, peak-counted)
+			counted = peak
+			if opts.MaxRegistryBytes > 0 && sum > opts.MaxRegistryBytes {
+				sh.err = ErrRegistryFull
+			}
+		}
+		for value := range sh.values {
+			// Keep draining after an error so the producer can finish.
+			if sh.err != nil {
+				continue
+			}
+			if sh.err = b.Add(value); sh.err == nil {
+				account()
+			}
+		}
+		if sh.err != nil {
+			return
+		}
+		sh.start = b.finishSuffixes()
+		sh.states = b.reg.states
+		account()
+	}
+
+	var err error
+	var cur *shard
+	prevValue := []byte{}
+	for value := range values {
+		if err != nil {
+			continue
+		}
+		if bytes.Compare(prevValue, value) >= 0 {
+			err = fmt.Errorf(
+				"cannot build a Mealy machine from out-of-order "+
+					"values: %v : %v",
+				prevValue, value)
+			continue
+		}
+		if cur == nil || prevValue[0] != value[0] {
+			if cur != nil {
+				close(cur.values)
+			}
+			cur = &shard{values: make(chan []byte, 64), done: make(chan bool)}
+			shards = append(shards, cur)
+			go build(cur)
+		}
+		cur.values <- value
+		prevValue = value
+	}
+	if cur != nil {
+		close(cur.values)
+	}
+	for _, sh := range shards {
+		<-sh.done
+		if err == nil {
+			err = sh.err
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Merge states in the order each shard created them. Since every shard's
+	// states are new to the shared registry in exactly the order they would
+	// have been created by a sequential build, this reproduces its numbering.
+	reg := newRegistry()
+	start := state{}
+	remapped := func(s state, ids []int) state {
+		ns := make(state, len(s))
+		for i, t := range s {
+			ns[i] = NewTransition(t.Trigger(), ids[t.ToState()], t.IsTerminal())
+		}
+		return ns
+	}
+	for _, sh := range shards {
+		ids := make([]int, len(sh.states))
+		for i, s := range sh.states {
+			ids[i] = reg.Register(remapped(s, ids))
+		}
+		for _, t := range remapped(sh.start, ids) {
+			start.AddTransition(t)
+		}
+		// Let the shard's states be collected once they are merged.
+		sh.states = nil
+		if reg.overflowed() {
+			return nil, ErrTooManyStates
+		}
+		if opts.MaxRegistryBytes > 0 && reg.peakBytes > opts.MaxRegistryBytes {
+			return nil, ErrRegistryFull
+		}
+	}
+
+	if startId := reg.Register(start); startId != len(reg.states)-1 {
+		panic(fmt.Sprintf(
+			"Unexpected start ID, not at the end: %v < %v",
+			startId, len(reg.states)-1))
+	}
+	if reg.overflowed() {
+		return nil, ErrTooManyStates
+	}
+	return reg.states, nil
+}
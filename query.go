@@ -0,0 +1,178 @@
+package mealy
+
+import (
+	"sort"
+)
+
+// Follow prefix from the start state, returning the state reached and whether
+// prefix itself is recognized. If the machine has no path for prefix, ok is
+// false.
+func walkPrefix(t stateTable, prefix []byte) (id int, terminal, ok bool) {
+	id = t.numStates() - 1
+	if id < 0 {
+		return
+	}
+	for _, v := range prefix {
+		s := t.stateAt(id)
+		i := s.IndexForTrigger(v)
+		if i >= len(s) {
+			return id, false, false
+		}
+		id, terminal = s[i].ToState(), s[i].IsTerminal()
+	}
+	return id, terminal, true
+}
+
+// Implements Completions for any representation.
+func completions(t stateTable, prefix []byte, limit int) [][]byte {
+	found := [][]byte{}
+	id, terminal, ok := walkPrefix(t, prefix)
+	if !ok {
+		return found
+	}
+	if terminal && len(prefix) > 0 {
+		found = append(found, append([]byte{}, prefix...))
+	}
+	full := func() bool { return limit > 0 && len(found) >= limit }
+
+	value := append([]byte{}, prefix...)
+	var walk func(id int)
+	walk = func(id int) {
+		for _, tr := range t.stateAt(id) {
+			if full() {
+				return
+			}
+			value = append(value, tr.Trigger())
+			if tr.IsTerminal() {
+				found = append(found, append([]byte{}, value...))
+			}
+			walk(tr.ToState())
+			value = value[:len(value)-1]
+		}
+	}
+	if !full() {
+		walk(id)
+	}
+	return found
+}
+
+// Implements CountSequences for any representation.
+func countSequences(t stateTable, prefix []byte) int64 {
+	id, terminal, ok := walkPrefix(t, prefix)
+	if !ok {
+		return 0
+	}
+	counts := make(map[int]int64)
+	var count func(id int) int64
+	count = func(id int) int64 {
+		if n, ok := counts[id]; ok {
+			return n
+		}
+		n := int64(0)
+		for _, tr := range t.stateAt(id) {
+			if tr.IsTerminal() {
+				n++
+			}
+			n += count(tr.ToState())
+		}
+		counts[id] = n
+		return n
+	}
+	n := count(id)
+	if terminal && len(prefix) > 0 {
+		n++
+	}
+	return n
+}
+
+// A recognized sequence that is close to a queried value.
+type Suggestion struct {
+	Value []byte
+	// The Levenshtein distance from the queried value: the number of single
+	// byte insertions, deletions and substitutions needed to turn one into
+	// the other.
+	Distance int
+}
+
+// Implements Suggest for any representation.
+//
+// This walks the machine depth first, keeping the row of the edit distance
+// table for the sequence so far against every prefix of value. A branch is
+// abandoned as soon as every entry in its row exceeds maxEdits, since no
+// extension of it can come any closer.
+func suggest(t stateTable, value []byte, maxEdits, limit int) []Suggestion {
+	found := []Suggestion{}
+	if t.numStates() == 0 || maxEdits < 0 {
+		return found
+	}
+	first := make([]int, len(value)+1)
+	for i := range first {
+		first[i] = i
+	}
+	path := []byte{}
+	var walk func(id int, prev []int)
+	walk = func(id int, prev []int) {
+		for _, tr := range t.stateAt(id) {
+			row := make([]int, len(prev))
+			row[0] = prev[0] + 1
+			best := row[0]
+			for i := 1; i < len(row); i++ {
+				cost := 1
+				if value[i-1] == tr.Trigger() {
+					cost = 0
+				}
+				row[i] = minInt(prev[i-1]+cost, minInt(prev[i]+1, row[i-1]+1))
+				best = minInt(best, row[i])
+			}
+			if best > maxEdits {
+				continue
+			}
+			path = append(path, tr.Trigger())
+			if d := row[len(row)-1]; tr.IsTerminal() && d <= maxEdits {
+				found = append(found, Suggestion{append([]byte{}, path...), d})
+			}
+			walk(tr.ToState(), row)
+			path = path[:len(path)-1]
+		}
+	}
+	walk(t.numStates()-1, first)
+
+	sort.SliceStable(found, func(i, j int) bool {
+		return found[i].Distance < found[j].Distance
+	})
+	if limit > 0 && len(found) > limit {
+		found = found[:limit]
+	}
+	return found
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// Return up to limit recognized sequences that begin with prefix (or all of
+// them if limit <= 0), in order, including prefix itself if it is recognized.
+//
+// Unlike PrefixSequences, this stops walking the machine once the limit is
+// reached, so it is suited to serving completions from a large machine.
+func (self Recognizer) Completions(prefix []byte, limit int) [][]byte {
+	return completions(self, prefix, limit)
+}
+
+// Return the number of recognized sequences that begin with prefix, including
+// prefix itself if it is recognized. With an empty prefix, this counts every
+// recognized sequence. Each state below prefix is visited only once, so this
+// is much faster than enumerating the sequences.
+func (self Recognizer) CountSequences(prefix []byte) int64 {
+	return countSequences(self, prefix)
+}
+
+// Return up to limit recognized sequences (or all of them if limit <= 0)
+// within maxEdits single-byte insertions, deletions and substitutions of
+// value, closest first and in order within each distance.
+func (self Recognizer) Suggest(value []byte, maxEdits, limit int) []Suggestion {
+	return suggest(self, value, maxEdits, limit)
+}
@@ -0,0 +1,312 @@
+package mealy
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Must always be 6 bytes.
+const indexedPrefix = "MMeMv4"
+
+// Size of the fixed header of an indexed machine: the prefix, then the number
+// of states and transitions as 32-bit integers.
+const indexedHeaderSize = 6 + 4 + 4
+
+// Write a machine with an index of where each state's transitions begin, so
+// that any state can be found without reading the ones before it. After the
+// header come the offsets of each state's first transition (plus one more for
+// the end of the last state), then all transitions, all as 32-bit integers.
+func (self Recognizer) writeIndexed(w io.Writer) (err error) {
+	bw := bufio.NewWriter(w)
+	total := self.TotalTransitions()
+	if err = binary.Write(bw, binary.BigEndian, [2]uint32{uint32(len(self)), uint32(total)}); err != nil {
+		return
+	}
+	offset := uint32(0)
+	for _, s := range self {
+		if err = binary.Write(bw, binary.BigEndian, offset); err != nil {
+			return
+		}
+		offset += uint32(len(s))
+	}
+	if err = binary.Write(bw, binary.BigEndian, offset); err != nil {
+		return
+	}
+	for _, s := range self {
+		if err = binary.Write(bw, binary.BigEndian, s); err != nil {
+			return
+		}
+	}
+	return bw.Flush()
+}
+
+func readIndexed(r io.Reader) (f FlatRecognizer, err error) {
+	var counts [2]uint32
+	if err = binary.Read(r, binary.BigEndian, &counts); err != nil {
+		return
+	}
+	if err = checkIndexedCounts(counts[0], counts[1]); err != nil {
+		return
+	}
+	f.offsets = make([]uint32, counts[0]+1)
+	if err = binary.Read(r, binary.BigEndian, f.offsets); err != nil {
+		return
+	}
+	for i := 1; i < len(f.offsets); i++ {
+		if f.offsets[i] < f.offsets[i-1] || f.offsets[i] > counts[1] {
+			err = fmt.Errorf("invalid offset for state %d", i-1)
+			return
+		}
+	}
+	if f.offsets[0] != 0 || f.offsets[len(f.offsets)-1] != counts[1] {
+		err = fmt.Errorf("offsets do not cover all %d transitions", counts[1])
+		return
+	}
+	// Read transitions in chunks, so that a count that claims more than the
+	// input holds fails before it is all allocated.
+	const chunk = 1 << 16
+	f.transitions = make([]transition, 0, minInt(int(counts[1]), chunk))
+	for remaining := int(counts[1]); remaining > 0; remaining -= chunk {
+		buf := make([]transition, minInt(remaining, chunk))
+		if err = binary.Read(r, binary.BigEndian, buf); err != nil {
+			return
+		}
+		f.transitions = append(f.transitions, buf...)
+	}
+	err = f.checkTargets()
+	return
+}
+
+// Check the state and transition counts from an indexed header: there can be
+// no more states than transitions can refer to, and no state can have more
+// than 256 transitions.
+func checkIndexedCounts(numStates, numTransitions uint32) error {
+	if numStates > maxStates {
+		return fmt.Errorf("state count %d exceeds the maximum of %d", numStates, maxStates)
+	}
+	if uint64(numTransitions) > 256*uint64(numStates) {
+		return fmt.Errorf("transition count %d is impossible for %d states", numTransitions, numStates)
+	}
+	return nil
+}
+
+// The number of pages cached by a ReaderAtRecognizer.
+const DefaultCachePages = 256
+
+// The size of each page cached by a ReaderAtRecognizer, in bytes.
+const cachePageSize = 4096
+
+// Answers queries about a machine serialized in FormatIndexed, reading only
+// the states it needs to. Recently read pages are kept in a small LRU cache.
+//
+// This suits machines too large to load into memory where memory mapping is
+// not an option, such as those embedded in other files. It is safe for
+// concurrent use.
+type ReaderAtRecognizer struct {
+	r              io.ReaderAt
+	size           int64
+	numStates      int
+	numTransitions uint32
+	transitions    int64
+	offsetsAt      int64
+
+	mu    sync.Mutex
+	pages map[int64]*list.Element
+	lru   *list.List
+}
+
+type cachePage struct {
+	index int64
+	data  []byte
+}
+
+// Open a machine serialized in FormatIndexed, which occupies the first size
+// bytes of r.
+func OpenReaderAt(r io.ReaderAt, size int64) (*ReaderAtRecognizer, error) {
+	m := &ReaderAtRecognizer{
+		r:     r,
+		size:  size,
+		pages: make(map[int64]*list.Element),
+		lru:   list.New(),
+	}
+	header := make([]byte, indexedHeaderSize)
+	if err := m.readAt(header, 0); err != nil {
+		return nil, err
+	}
+	if string(header[:len(indexedPrefix)]) != indexedPrefix {
+		return nil, fmt.Errorf("not an indexed machine: prefix %q", header[:len(indexedPrefix)])
+	}
+	if err := checkIndexedCounts(binary.BigEndian.Uint32(header[6:]), binary.BigEndian.Uint32(header[10:])); err != nil {
+		return nil, err
+	}
+	m.numStates = int(binary.BigEndian.Uint32(header[6:]))
+	m.numTransitions = binary.BigEndian.Uint32(header[10:])
+	m.offsetsAt = indexedHeaderSize
+	m.transitions = m.offsetsAt + 4*int64(m.numStates+1)
+	if end := m.transitions + 4*int64(m.numTransitions); end > size {
+		return nil, fmt.Errorf("indexed machine needs %d bytes, but only %d are available", end, size)
+	}
+	return m, nil
+}
+
+// Fill p with the bytes at the given offset, going through the page cache.
+func (m *ReaderAtRecognizer) readAt(p []byte, off int64) error {
+	if off < 0 || off+int64(len(p)) > m.size {
+		return io.ErrUnexpectedEOF
+	}
+	for len(p) > 0 {
+		page, err := m.page(off / cachePageSize)
+		if err != nil {
+			return err
+		}
+		n := copy(p, page[off%cachePageSize:])
+		p = p[n:]
+		off += int64(n)
+	}
+	return nil
+}
+
+// Return the page with the given index, reading it if it is not cached.
+func (m *ReaderAtRecognizer) page(index int64) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e, ok := m.pages[index]; ok {
+		m.lru.MoveToFront(e)
+		return e.Value.(*cachePage).data, nil
+	}
+
+	start := index * cachePageSize
+	size := int64(cachePageSize)
+	if start+size > m.size {
+		size = m.size - start
+	}
+	data := make([]byte, size)
+	if n, err := m.r.ReadAt(data, start); n < len(data) {
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	m.pages[index] = m.lru.PushFront(&cachePage{index, data})
+	if m.lru.Len() > DefaultCachePages {
+		oldest := m.lru.Remove(m.lru.Back()).(*cachePage)
+		delete(m.pages, oldest.index)
+	}
+	return data, nil
+}
+
+// Read the transitions for the state with the given ID.
+func (m *ReaderAtRecognizer) state(id int) (state, error) {
+	if id < 0 || id >= m.numStates {
+		return nil, fmt.Errorf("state %d out of range", id)
+	}
+	var offsets [8]byte
+	if err := m.readAt(offsets[:], m.offsetsAt+4*int64(id)); err != nil {
+		return nil, err
+	}
+	start := binary.BigEndian.Uint32(offsets[:])
+	end := binary.BigEndian.Uint32(offsets[4:])
+	// Check before allocating, so corrupt offsets cannot force a huge one.
+	if end < start || end-start > 256 || end > m.numTransitions {
+		return nil, fmt.Errorf("invalid offsets for state %d", id)
+	}
+	raw := make([]byte, 4*(end-start))
+	if err := m.readAt(raw, m.transitions+4*int64(start)); err != nil {
+		return nil, err
+	}
+	s := make(state, end-start)
+	for i := range s {
+		s[i] = transition(binary.BigEndian.Uint32(raw[4*i:]))
+	}
+	return s, nil
+}
+
+// Return the number of states.
+func (m *ReaderAtRecognizer) Len() int {
+	return m.numStates
+}
+
+// Return the ID of the start state, suitable for passing to Step.
+func (m *ReaderAtRecognizer) StartId() int {
+	return m.numStates - 1
+}
+
+// Follow a transition, as Recognizer.Step does, reading the state if needed.
+func (m *ReaderAtRecognizer) Step(id int, value byte) (next int, terminal, ok bool, err error) {
+	s, err := m.state(id)
+	if err != nil {
+		return
+	}
+	if i := s.IndexForTrigger(value); i < len(s) {
+		return s[i].ToState(), s[i].IsTerminal(), true, nil
+	}
+	return
+}
+
+func (m *ReaderAtRecognizer) Recognizes(value []byte) (bool, error) {
+	if m.numStates == 0 {
+		return false, nil
+	}
+	id, terminal := m.StartId(), false
+	for _, v := range value {
+		var ok bool
+		var err error
+		if id, terminal, ok, err = m.Step(id, v); err != nil || !ok {
+			return false, err
+		}
+	}
+	return terminal, nil
+}
+
+// Return up to limit recognized sequences that begin with prefix (or all of
+// them if limit <= 0), in order.
+func (m *ReaderAtRecognizer) PrefixSequences(prefix []byte, limit int) ([][]byte, error) {
+	found := [][]byte{}
+	if m.numStates == 0 {
+		return found, nil
+	}
+	id, terminal := m.StartId(), false
+	for _, v := range prefix {
+		var ok bool
+		var err error
+		if id, terminal, ok, err = m.Step(id, v); err != nil || !ok {
+			return found, err
+		}
+	}
+	if terminal && len(prefix) > 0 {
+		found = append(found, append([]byte{}, prefix...))
+	}
+
+	value := append([]byte{}, prefix...)
+	var walk func(id int) error
+	walk = func(id int) error {
+		s, err := m.state(id)
+		if err != nil {
+			return err
+		}
+		for _, t := range s {
+			if limit > 0 && len(found) >= limit {
+				return nil
+			}
+			value = append(value, t.Trigger())
+			if t.IsTerminal() {
+				found = append(found, append([]byte{}, value...))
+			}
+			if err = walk(t.ToState()); err != nil {
+				return err
+			}
+			value = value[:len(value)-1]
+		}
+		return nil
+	}
+	if limit > 0 && len(found) >= limit {
+		return found, nil
+	}
+	err := walk(id)
+	return found, err
+}
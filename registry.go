@@ -0,0 +1,123 @@
+package mealy
+
+// Keeps track of every distinct state created so far, so that equivalent
+// states are only ever stored once. Registering states bottom-up is what keeps
+// a machine minimal.
+//
+// States are found with an open-addressed hash table of their IDs, and are
+// compared transition by transition, so there is no chance of two different
+// states colliding.
+//
+// Registered states must never be modified, since they are shared by every
+// transition that leads to them.
+type registry struct {
+	states Recognizer
+	// State IDs plus one, so that zero marks an empty slot. The length is
+	// always a power of two, and is kept at least twice the number of states.
+	slots []uint32
+	// Number of transitions over all states.
+	transitions int64
+	// Largest value of Bytes so far, including while the table grows.
+	peakBytes int64
+	// The most states that may be registered before their IDs no longer fit
+	// in a transition. Zero means maxStates; only tests set it lower.
+	capacity int
+}
+
+func newRegistry() *registry {
+	return &registry{}
+}
+
+// Create a registry from the states of an existing minimal machine.
+func registryFor(m Recognizer) *registry {
+	r := &registry{states: append(Recognizer{}, m...)}
+	for _, s := range m {
+		r.transitions += int64(len(s))
+	}
+	r.resize(len(m))
+	return r
+}
+
+// Return true if more states have been registered than transitions can refer
+// to, so that some transitions have been given truncated IDs.
+func (r *registry) overflowed() bool {
+	capacity := r.capacity
+	if capacity == 0 {
+		capacity = maxStates
+	}
+	return len(r.states) > capacity
+}
+
+// Hash a state's transitions with FNV-1a.
+func hashState(s state) uint32 {
+	h := uint32(2166136261)
+	for _, t := range s {
+		for shift := 0; shift < 32; shift += 8 {
+			h ^= uint32(t>>shift) & 0xff
+			h *= 16777619
+		}
+	}
+	return h
+}
+
+func equalStates(a, b state) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Return the estimated memory used by the registry, in bytes, including the
+// states it holds.
+func (r *registry) Bytes() int64 {
+	const sliceHeader = 24
+	return int64(len(r.slots))*4 + int64(len(r.states))*sliceHeader + r.transitions*4
+}
+
+// Rebuild the table with enough room for n states.
+func (r *registry) resize(n int) {
+	size := 1024
+	for size < 2*n {
+		size *= 2
+	}
+	old := r.slots
+	r.slots = make([]uint32, size)
+	if b := r.Bytes() + int64(len(old))*4; b > r.peakBytes {
+		r.peakBytes = b
+	}
+	mask := uint32(size - 1)
+	for id, s := range r.states {
+		i := hashState(s) & mask
+		for r.slots[i] != 0 {
+			i = (i + 1) & mask
+		}
+		r.slots[i] = uint32(id) + 1
+	}
+}
+
+// Find or create a state corresponding to what's passed in, returning its ID.
+func (r *registry) Register(s state) int {
+	if 2*(len(r.states)+1) > len(r.slots) {
+		r.resize(len(r.states) + 1)
+	}
+	mask := uint32(len(r.slots) - 1)
+	i := hashState(s) & mask
+	for ; r.slots[i] != 0; i = (i + 1) & mask {
+		if id := int(r.slots[i] - 1); equalStates(r.states[id], s) {
+			return id
+		}
+	}
+	id := len(r.states)
+	r.states = append(r.states, s)
+	r.transitions += int64(len(s))
+	r.slots[i] = uint32(id) + 1
+	if b := r.Bytes(); b > r.peakBytes {
+		r.peakBytes = b
+	}
+	return id
+}
@@ -0,0 +1,97 @@
+package mealy
+
+import (
+	"sort"
+)
+
+// Decides the order in which states are laid out by Reorder.
+type ReorderStrategy interface {
+	// Return the IDs of all states to keep, most important first. The start
+	// state must come first.
+	order(m Recognizer) []int
+}
+
+type breadthFirst struct{}
+
+// Lay out states in the order a breadth-first walk from the start state
+// reaches them, so that the states along any path are close together, and the
+// shallow states that every lookup visits are packed tightly.
+func BreadthFirst() ReorderStrategy {
+	return breadthFirst{}
+}
+
+func (breadthFirst) order(m Recognizer) []int {
+	if len(m) == 0 {
+		return nil
+	}
+	seen := make([]bool, len(m))
+	order := []int{m.StartId()}
+	seen[m.StartId()] = true
+	for i := 0; i < len(order); i++ {
+		for _, t := range m[order[i]] {
+			if id := t.ToState(); !seen[id] {
+				seen[id] = true
+				order = append(order, id)
+			}
+		}
+	}
+	return order
+}
+
+type byFrequency struct {
+	sample <-chan []byte
+}
+
+// Lay out states by how often they are visited while recognizing the values
+// in sample, most often first. States that are never visited follow, in
+// breadth-first order. The sample is consumed when Reorder is called.
+func ByFrequency(sample <-chan []byte) ReorderStrategy {
+	return byFrequency{sample}
+}
+
+func (s byFrequency) order(m Recognizer) []int {
+	counts := make([]int, len(m))
+	for value := range s.sample {
+		id := m.StartId()
+		for _, b := range value {
+			var ok bool
+			if id, _, ok = m.Step(id, b); !ok {
+				break
+			}
+			counts[id]++
+		}
+	}
+	order := breadthFirst{}.order(m)
+	if len(order) > 0 {
+		// The start state stays first regardless of its count.
+		rest := order[1:]
+		sort.SliceStable(rest, func(i, j int) bool {
+			return counts[rest[i]] > counts[rest[j]]
+		})
+	}
+	return order
+}
+
+// Return an equivalent machine with its states renumbered according to the
+// given strategy, which can make lookups considerably more cache friendly
+// than the creation order used by FromChannel. Unreachable states are dropped.
+//
+// Since the start state is always the last one, the order is laid out from the
+// end of the machine backward: the start state keeps the last ID, the next
+// state in the order gets the one before it, and so on.
+func (self Recognizer) Reorder(strategy ReorderStrategy) Recognizer {
+	order := strategy.order(self)
+	ids := make([]int, len(self))
+	for i, old := range order {
+		ids[old] = len(order) - 1 - i
+	}
+	out := make(Recognizer, len(order))
+	for _, old := range order {
+		s := make(state, len(self[old]))
+		for i, t := range self[old] {
+			s[i] = NewTransition(t.Trigger(), ids[t.ToState()], t.IsTerminal())
+		}
+		out[ids[old]] = s
+	}
+	return out
+}
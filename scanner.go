@@ -0,0 +1,133 @@
+package mealy
+
+import (
+	"io"
+)
+
+// An occurrence of a recognized sequence in a scanned stream. Offset is the
+// position of its first byte, counting from the start of the stream.
+type Match struct {
+	Offset int64
+	Word   []byte
+}
+
+// Options for a Scanner.
+type ScanOptions struct {
+	// Report only non-overlapping matches, choosing the leftmost match first
+	// and the longest one among those starting at the same offset. By
+	// default, every occurrence of every recognized sequence is reported.
+	LeftmostLongest bool
+}
+
+// A partial match in progress, started at a given stream offset.
+type scanCursor struct {
+	start int64
+	id    int
+	word  []byte
+	alive bool
+	// Length of the longest match found so far, or 0 if none.
+	best int
+}
+
+// Finds recognized sequences in a stream of bytes, in the manner of
+// Aho-Corasick: every byte starts a new cursor into the machine, and each
+// cursor is advanced until the machine rejects it. Write the stream to the
+// Scanner (it implements io.Writer), then call Close to flush any pending
+// matches; or use Scan to do both with an io.Reader.
+//
+// In the default mode, each match is reported as soon as its last byte is
+// scanned, so matches are ordered by where they end. In leftmost-longest mode,
+// a match is held back until no earlier or longer match is possible, and
+// matches are ordered by where they begin.
+type Scanner struct {
+	m       Recognizer
+	opts    ScanOptions
+	report  func(Match)
+	cursors []scanCursor
+	offset  int64
+	// In leftmost-longest mode, no match may start before this offset.
+	next int64
+}
+
+// Create a scanner that calls report for every match of the given machine.
+func NewScanner(m Recognizer, opts ScanOptions, report func(Match)) *Scanner {
+	return &Scanner{m: m, opts: opts, report: report}
+}
+
+// Scan a chunk of the stream. Never returns an error.
+func (s *Scanner) Write(p []byte) (int, error) {
+	for _, b := range p {
+		s.scanByte(b)
+	}
+	return len(p), nil
+}
+
+// Signal the end of the stream, reporting any matches that were waiting for
+// longer candidates to be ruled out. Never returns an error.
+func (s *Scanner) Close() error {
+	for i := range s.cursors {
+		s.cursors[i].alive = false
+	}
+	s.resolve()
+	s.cursors = s.cursors[:0]
+	return nil
+}
+
+// Scan everything from r, then Close the scanner.
+func (s *Scanner) Scan(r io.Reader) error {
+	if _, err := io.Copy(s, r); err != nil {
+		return err
+	}
+	return s.Close()
+}
+
+func (s *Scanner) scanByte(b byte) {
+	if !s.opts.LeftmostLongest || s.offset >= s.next {
+		s.cursors = append(s.cursors, scanCursor{start: s.offset, id: s.m.StartId(), alive: true})
+	}
+	s.offset++
+
+	// Advance everything, dropping cursors that can no longer produce
+	// anything to report.
+	kept := s.cursors[:0]
+	for _, c := range s.cursors {
+		if c.alive {
+			next, terminal, ok := s.m.Step(c.id, b)
+			if ok {
+				c.id = next
+				c.word = append(c.word, b)
+				if terminal {
+					if s.opts.LeftmostLongest {
+						c.best = len(c.word)
+					} else {
+						s.report(Match{c.start, append([]byte{}, c.word...)})
+					}
+				}
+			}
+			c.alive = ok && !s.m[next].IsEmpty()
+		}
+		if c.alive || c.best > 0 {
+			kept = append(kept, c)
+		}
+	}
+	s.cursors = kept
+	s.resolve()
+}
+
+// Report matches for cursors at the front of the list that are finished. A
+// finished cursor can only be reported once every cursor that started before
+// it is finished, since those take precedence.
+func (s *Scanner) resolve() {
+	for len(s.cursors) > 0 && !s.cursors[0].alive {
+		c := s.cursors[0]
+		s.cursors = s.cursors[1:]
+		if c.best == 0 {
+			continue
+		}
+		s.report(Match{c.start, c.word[:c.best]})
+		s.next = c.start + int64(c.best)
+		for len(s.cursors) > 0 && s.cursors[0].start < s.next {
+			s.cursors = s.cursors[1:]
+		}
+	}
+}
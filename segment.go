@@ -0,0 +1,117 @@
+package mealy
+
+// Return the lengths of all non-empty prefixes of value that are recognized,
+// shortest first. This is a single walk through the machine, stopping as soon
+// as no longer prefix can be recognized.
+func (self Recognizer) PrefixLengths(value []byte) []int {
+	lengths := []int{}
+	id := self.StartId()
+	for i, b := range value {
+		var terminal, ok bool
+		if id, terminal, ok = self.Step(id, b); !ok {
+			break
+		}
+		if terminal {
+			lengths = append(lengths, i+1)
+		}
+	}
+	return lengths
+}
+
+// Return the recognized prefix lengths for every offset of text, so that
+// ends[i] holds the lengths of recognized sequences starting at text[i].
+func (self Recognizer) wordEnds(text []byte) [][]int {
+	ends := make([][]int, len(text))
+	for i := range text {
+		ends[i] = self.PrefixLengths(text[i:])
+	}
+	return ends
+}
+
+// Split text into recognized sequences, using as few of them as possible. If
+// there is more than one such split, the one with the longest leading words
+// is preferred. Returns nil if text cannot be split at all (or is empty).
+func (self Recognizer) Segment(text []byte) [][]byte {
+	return self.SegmentScored(text, func([]byte) float64 { return -1 })
+}
+
+// Split text into recognized sequences, maximizing the sum of score over the
+// resulting words. Ties are broken in favor of longer leading words. Returns
+// nil if text cannot be split at all (or is empty).
+func (self Recognizer) SegmentScored(text []byte, score func(word []byte) float64) [][]byte {
+	ends := self.wordEnds(text)
+
+	// best[i] is the best score for splitting text[i:], and next[i] is the
+	// length of the first word in that split, or 0 if there is none.
+	best := make([]float64, len(text)+1)
+	next := make([]int, len(text)+1)
+	for i := len(text) - 1; i >= 0; i-- {
+		for j := len(ends[i]) - 1; j >= 0; j-- {
+			l := ends[i][j]
+			if i+l < len(text) && next[i+l] == 0 {
+				continue
+			}
+			s := score(text[i:i+l]) + best[i+l]
+			if next[i] == 0 || s > best[i] {
+				best[i], next[i] = s, l
+			}
+		}
+	}
+
+	if len(text) == 0 || next[0] == 0 {
+		return nil
+	}
+	words := [][]byte{}
+	for i := 0; i < len(text); i += next[i] {
+		words = append(words, text[i:i+next[i]])
+	}
+	return words
+}
+
+// Return every way of splitting text into recognized sequences, up to limit
+// of them (or all of them if limit <= 0). Splits are ordered by the lengths of
+// their words, shortest first.
+func (self Recognizer) AllSegmentations(text []byte, limit int) [][][]byte {
+	ends := self.wordEnds(text)
+
+	// Only offsets from which the rest of the text can be split are worth
+	// exploring.
+	splittable := make([]bool, len(text)+1)
+	splittable[len(text)] = true
+	for i := len(text) - 1; i >= 0; i-- {
+		for _, l := range ends[i] {
+			if splittable[i+l] {
+				splittable[i] = true
+				break
+			}
+		}
+	}
+
+	splits := [][][]byte{}
+	if len(text) == 0 || !splittable[0] {
+		return splits
+	}
+
+	words := [][]byte{}
+	var split func(i int) bool
+	split = func(i int) bool {
+		if i == len(text) {
+			splits = append(splits, append([][]byte{}, words...))
+			return limit <= 0 || len(splits) < limit
+		}
+		for _, l := range ends[i] {
+			if !splittable[i+l] {
+				continue
+			}
+			words = append(words, text[i:i+l])
+			more := split(i + l)
+			words = words[:len(words)-1]
+			if !more {
+				return false
+			}
+		}
+		return true
+	}
+	split(0)
+	return splits
+}
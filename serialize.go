@@ -1,24 +1,203 @@
 package mealy
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
 )
 
 // Must always be 6 bytes.
 const serializationPrefix = "MMeMv1"
 
-// Serialize the Mealy machine to a Writer.
-func (self Recognizer) WriteTo(w io.Writer) (err error) {
-	if err = binary.Write(w, binary.BigEndian, []byte(serializationPrefix)); err != nil {
+// Serialization formats. Every format starts with its own 6-byte prefix, so
+// readers can tell them apart.
+type Format int
+
+const (
+	// A 32-bit state count and one byte of fanout per state, followed
+	// by each of its transitions as a 32-bit integer. Since the fanout is a
+	// single byte, machines with a state that has transitions for all 256
+	// byte values cannot be written in this format.
+	FormatPlain Format = iota
+	// Bit-packed states that index a table of unique transitions, which are
+	// themselves bit-packed using a table of trigger values.
+	FormatPacked
+	// Variable-length fanouts, trigger deltas, and relative target state IDs.
+	FormatVarint
+	// An index of state offsets followed by 32-bit transitions, so that
+	// states can be read at random. See OpenReaderAt.
+	FormatIndexed
+)
+
+var formatPrefixes = map[Format]string{
+	FormatPlain:   serializationPrefix,
+	FormatPacked:  packedPrefix,
+	FormatVarint:  varintPrefix,
+	FormatIndexed: indexedPrefix,
+}
+
+var formatNames = map[Format]string{
+	FormatPlain:   "plain",
+	FormatPacked:  "packed",
+	FormatVarint:  "varint",
+	FormatIndexed: "indexed",
+}
+
+func (f Format) String() string {
+	if name, ok := formatNames[f]; ok {
+		return name
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+// Return the format with the given name, as returned by its String method.
+func ParseFormat(name string) (Format, error) {
+	for f, n := range formatNames {
+		if n == name {
+			return f, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown serialization format %q", name)
+}
+
+// Counts the bytes passing through a Writer.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Counts the bytes passing through a Reader.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Counts the bytes passing through a Reader that is also an io.ByteReader, so
+// that the formats reading a byte at a time need not buffer it.
+type countingByteReader struct {
+	countingReader
+	br io.ByteReader
+}
+
+func (c *countingByteReader) ReadByte() (byte, error) {
+	b, err := c.br.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+// Return r as an io.ByteReader. If it is not one already, it is wrapped in a
+// buffer, which may consume bytes from r beyond the end of the machine.
+func byteReader(r io.Reader) io.ByteReader {
+	if br, ok := r.(io.ByteReader); ok {
+		return br
+	}
+	return bufio.NewReader(r)
+}
+
+// Serialize the Mealy machine to a Writer, returning the number of bytes
+// written. Implements io.WriterTo.
+func (self Recognizer) WriteTo(w io.Writer) (int64, error) {
+	c := &countingWriter{w: w}
+	err := self.WriteFormat(c, FormatPlain)
+	return c.n, err
+}
+
+// Replace this machine with one deserialized from a Reader in any format,
+// returning the number of bytes read. Implements io.ReaderFrom.
+//
+// Some formats are read a byte at a time. Unless r implements io.ByteReader,
+// as *bufio.Reader and *bytes.Reader do, they are read through a buffer, so
+// more bytes than the machine occupies may be consumed from r.
+func (self *Recognizer) ReadFrom(r io.Reader) (int64, error) {
+	var c io.Reader
+	var n *int64
+	if br, ok := r.(io.ByteReader); ok {
+		cbr := &countingByteReader{countingReader{r: r}, br}
+		c, n = cbr, &cbr.n
+	} else {
+		cr := &countingReader{r: r}
+		c, n = cr, &cr.n
+	}
+	m, err := ReadFrom(c)
+	if err == nil {
+		*self = m
+	}
+	return *n, err
+}
+
+// Serialize the machine in FormatVarint, the most compact format that needs
+// no tables. Implements encoding.BinaryMarshaler.
+func (self Recognizer) MarshalBinary() ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := self.WriteFormat(&buffer, FormatVarint); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// Replace this machine with one deserialized from data in any format.
+// Implements encoding.BinaryUnmarshaler.
+func (self *Recognizer) UnmarshalBinary(data []byte) error {
+	_, err := self.ReadFrom(bytes.NewReader(data))
+	return err
+}
+
+// Implements gob.GobEncoder, using the same encoding as MarshalBinary.
+func (self Recognizer) GobEncode() ([]byte, error) {
+	return self.MarshalBinary()
+}
+
+// Implements gob.GobDecoder, using the same encoding as UnmarshalBinary.
+func (self *Recognizer) GobDecode(data []byte) error {
+	return self.UnmarshalBinary(data)
+}
+
+// Serialize the Mealy machine to a Writer in the given format. Any format can
+// be read back with ReadFrom or ReadFlatFrom.
+func (self Recognizer) WriteFormat(w io.Writer, format Format) (err error) {
+	prefix, ok := formatPrefixes[format]
+	if !ok {
+		return fmt.Errorf("unknown serialization format %d", format)
+	}
+	if err = binary.Write(w, binary.BigEndian, []byte(prefix)); err != nil {
 		return
 	}
+	switch format {
+	case FormatPacked:
+		return self.writePacked(w)
+	case FormatVarint:
+		return self.writeVarint(w)
+	case FormatIndexed:
+		return self.writeIndexed(w)
+	}
+	return self.writePlain(w)
+}
 
+func (self Recognizer) writePlain(w io.Writer) (err error) {
 	if err = binary.Write(w, binary.BigEndian, int32(len(self))); err != nil {
 		return
 	}
 
-	for _, s := range self {
+	for id, s := range self {
+		if len(s) > 0xff {
+			return fmt.Errorf("state %d has %d transitions, more than the plain format can hold; use another format", id, len(s))
+		}
 		if err = binary.Write(w, binary.BigEndian, byte(len(s))); err != nil {
 			break
 		}
@@ -29,35 +208,70 @@ func (self Recognizer) WriteTo(w io.Writer) (err error) {
 	return
 }
 
-// Deserialize the Mealy machine from a Reader.
+// Deserialize the Mealy machine from a Reader. As with Recognizer.ReadFrom,
+// more bytes than the machine occupies may be consumed from r unless it
+// implements io.ByteReader.
 func ReadFrom(r io.Reader) (self Recognizer, err error) {
-	// Read version string, then all states in order (each is a slice over
-	// uint32).
+	f, err := readFlat(r)
+	if err != nil {
+		return
+	}
+	return f.Recognizer(), nil
+}
+
+// Deserialize the Mealy machine from a Reader directly into a flat machine,
+// without allocating each state separately.
+func ReadFlatFrom(r io.Reader) (f FlatRecognizer, err error) {
+	if f, err = readFlat(r); err != nil {
+		return
+	}
+	return f.WithDenseFanout(DenseFanout), nil
+}
+
+// Read a flat machine without dense tables, in whatever format its prefix
+// specifies.
+func readFlat(r io.Reader) (f FlatRecognizer, err error) {
 	versionString := make([]byte, len(serializationPrefix))
 	if err = binary.Read(r, binary.BigEndian, versionString); err != nil {
 		return
 	}
+	switch string(versionString) {
+	case serializationPrefix:
+		return readPlain(r)
+	case packedPrefix:
+		return readPacked(r)
+	case varintPrefix:
+		return readVarint(r)
+	case indexedPrefix:
+		return readIndexed(r)
+	}
+	err = fmt.Errorf("unknown serialization format %q", versionString)
+	return
+}
 
+func readPlain(r io.Reader) (f FlatRecognizer, err error) {
+	// Read all states in order (each is a slice over uint32).
 	var numStates int32
 	if err = binary.Read(r, binary.BigEndian, &numStates); err != nil {
 		return
 	}
+	if numStates < 0 || numStates > maxStates {
+		err = fmt.Errorf("state count %d is out of range", numStates)
+		return
+	}
 
-	self = make(Recognizer, numStates)
+	f.offsets = make([]uint32, 1, numStates+1)
 	for i := 0; i < int(numStates); i++ {
 		var numTransitions byte
 		if err = binary.Read(r, binary.BigEndian, &numTransitions); err != nil {
 			return
 		}
 		st := make(state, numTransitions)
-		for t := 0; t < int(numTransitions); t++ {
-			var tr transition
-			if err = binary.Read(r, binary.BigEndian, &tr); err != nil {
-				return
-			}
-			st[t] = tr
+		if err = binary.Read(r, binary.BigEndian, st); err != nil {
+			return
 		}
-		self[i] = st
+		f.appendState(st)
 	}
+	err = f.checkTargets()
 	return
 }
@@ -0,0 +1,267 @@
+package mealy
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"io"
+	"os"
+	"sort"
+)
+
+// The memory budget used by a Sorter when none is specified: 64MiB.
+const DefaultSortMemory = 64 << 20
+
+// Options for sorting values that are too numerous to fit in memory.
+type SortOptions struct {
+	// Approximate number of bytes of values to hold in memory before a
+	// sorted run is written to a temporary file. If zero, DefaultSortMemory
+	// is used.
+	MemoryBudget int
+	// Directory in which temporary files are created. If empty, the default
+	// directory for temporary files is used.
+	TempDir string
+}
+
+// Sorts and removes duplicates from values added in any order. When the values
+// exceed the memory budget, they are written out in sorted runs to temporary
+// files, which are then merged when the sorted values are requested.
+type Sorter struct {
+	opts     SortOptions
+	buf      [][]byte
+	bufBytes int
+	runs     []*os.File
+	err      error
+}
+
+func NewSorter(opts SortOptions) *Sorter {
+	if opts.MemoryBudget <= 0 {
+		opts.MemoryBudget = DefaultSortMemory
+	}
+	return &Sorter{opts: opts}
+}
+
+// Add a value to be sorted. The value is copied, so the caller may reuse it.
+// Returns any error encountered while writing a sorted run, after which all
+// further values are ignored.
+func (s *Sorter) Add(value []byte) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.buf = append(s.buf, append([]byte(nil), value...))
+	// Count slice overhead, too, so that tiny values don't blow the budget.
+	s.bufBytes += len(value) + 24
+	if s.bufBytes >= s.opts.MemoryBudget {
+		s.err = s.spill()
+	}
+	return s.err
+}
+
+// Return the first error encountered, if any. Since errors can occur while
+// merging, this must be checked after the channel returned by Sorted has been
+// drained.
+func (s *Sorter) Err() error {
+	return s.err
+}
+
+func (s *Sorter) sortBuf() {
+	sort.Slice(s.buf, func(i, j int) bool {
+		return bytes.Compare(s.buf[i], s.buf[j]) < 0
+	})
+}
+
+// Write the buffered values to a new temporary file as a sorted run of
+// uvarint-length-prefixed values.
+func (s *Sorter) spill() (err error) {
+	s.sortBuf()
+	f, err := os.CreateTemp(s.opts.TempDir, "mealy-sort-")
+	if err != nil {
+		return
+	}
+	s.runs = append(s.runs, f)
+	w := bufio.NewWriter(f)
+	lenBuf := make([]byte, binary.MaxVarintLen64)
+	for _, v := range s.buf {
+		n := binary.PutUvarint(lenBuf, uint64(len(v)))
+		if _, err = w.Write(lenBuf[:n]); err != nil {
+			return
+		}
+		if _, err = w.Write(v); err != nil {
+			return
+		}
+	}
+	if err = w.Flush(); err != nil {
+		return
+	}
+	s.buf = s.buf[:0]
+	s.bufBytes = 0
+	return
+}
+
+// Return a channel that produces all added values in order, without
+// duplicates. No values may be added once this is called. The channel must be
+// drained, after which any temporary files have been removed, and Err reports
+// whether anything went wrong along the way.
+func (s *Sorter) Sorted() <-chan []byte {
+	out := make(chan []byte)
+	go func() {
+		defer close(out)
+		defer s.removeRuns()
+		if s.err != nil {
+			return
+		}
+
+		s.sortBuf()
+		sources := &mergeHeap{}
+		if len(s.buf) > 0 {
+			sources.sources = append(sources.sources, &sliceSource{values: s.buf})
+		}
+		for _, f := range s.runs {
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				s.err = err
+				return
+			}
+			sources.sources = append(sources.sources, &runSource{r: bufio.NewReader(f)})
+		}
+
+		// Prime every source, then repeatedly take the smallest.
+		live := sources.sources[:0]
+		for _, src := range sources.sources {
+			if ok, err := src.next(); err != nil {
+				s.err = err
+				return
+			} else if ok {
+				live = append(live, src)
+			}
+		}
+		sources.sources = live
+		heap.Init(sources)
+
+		var prev []byte
+		for first := true; sources.Len() > 0; first = false {
+			src := sources.sources[0]
+			if v := src.value(); first || !bytes.Equal(prev, v) {
+				out <- v
+				prev = v
+			}
+			if ok, err := src.next(); err != nil {
+				s.err = err
+				return
+			} else if ok {
+				heap.Fix(sources, 0)
+			} else {
+				heap.Pop(sources)
+			}
+		}
+	}()
+	return out
+}
+
+// Remove any temporary files holding sorted runs. Values added so far are
+// lost. This is done automatically once the channel returned by Sorted is
+// drained, so it is only needed when a Sorter is abandoned before then, but it
+// is safe to call more than once. It must not be called while the channel
+// returned by Sorted is being drained.
+func (s *Sorter) Close() error {
+	return s.removeRuns()
+}
+
+func (s *Sorter) removeRuns() (err error) {
+	for _, f := range s.runs {
+		f.Close()
+		if rerr := os.Remove(f.Name()); rerr != nil && err == nil {
+			err = rerr
+		}
+	}
+	s.runs = nil
+	s.buf = nil
+	s.bufBytes = 0
+	return
+}
+
+// A sorted sequence of values to be merged.
+type mergeSource interface {
+	// Advance to the next value, returning false when there are no more.
+	next() (bool, error)
+	value() []byte
+}
+
+type sliceSource struct {
+	values [][]byte
+	i      int
+}
+
+func (s *sliceSource) next() (bool, error) {
+	s.i++
+	return s.i <= len(s.values), nil
+}
+func (s *sliceSource) value() []byte {
+	return s.values[s.i-1]
+}
+
+type runSource struct {
+	r   *bufio.Reader
+	cur []byte
+}
+
+func (s *runSource) next() (bool, error) {
+	size, err := binary.ReadUvarint(s.r)
+	if err == io.EOF {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	s.cur = make([]byte, size)
+	if _, err = io.ReadFull(s.r, s.cur); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+func (s *runSource) value() []byte {
+	return s.cur
+}
+
+// Implements heap.Interface, ordering sources by their current values.
+type mergeHeap struct {
+	sources []mergeSource
+}
+
+func (h *mergeHeap) Len() int {
+	return len(h.sources)
+}
+func (h *mergeHeap) Less(i, j int) bool {
+	return bytes.Compare(h.sources[i].value(), h.sources[j].value()) < 0
+}
+func (h *mergeHeap) Swap(i, j int) {
+	h.sources[i], h.sources[j] = h.sources[j], h.sources[i]
+}
+func (h *mergeHeap) Push(x interface{}) {
+	h.sources = append(h.sources, x.(mergeSource))
+}
+func (h *mergeHeap) Pop() interface{} {
+	x := h.sources[len(h.sources)-1]
+	h.sources = h.sources[:len(h.sources)-1]
+	return x
+}
+
+// Builds a new mealy machine from values in any order, sorting them and
+// removing duplicates first. Empty values are skipped, since they cannot be
+// recognized. Values beyond the memory budget in opts are sorted in runs on
+// disk and merged, so inputs much larger than memory can be used.
+//
+// The channel is always drained, even if an error occurs.
+func FromUnsorted(values <-chan []byte, opts SortOptions) (Recognizer, error) {
+	s := NewSorter(opts)
+	defer s.Close()
+	for v := range values {
+		if len(v) > 0 {
+			s.Add(v)
+		}
+	}
+	m := FromChannel(s.Sorted())
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/sha1"
 	"encoding/base64"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"sort"
 	"strings"
@@ -18,6 +19,14 @@ import (
 // - 23 bits: next state ID (We can thus handle a little over 8 million states).
 type transition uint32
 
+// The number of distinct state IDs a transition can refer to. Serialized
+// machines claiming more states than this are corrupt.
+const maxStates = 1 << 23
+
+// Returned when a machine would need more states than transitions can refer
+// to.
+var ErrTooManyStates = errors.New("machine needs more than 1<<23 states")
+
 // Create a new transition, triggered by "trigger", passing to state
 // "toStateId", and with terminal status "isTerminal".
 func NewTransition(trigger byte, toStateId int, isTerminal bool) transition {
@@ -76,6 +85,9 @@ func (s state) IsEmpty() bool {
 }
 
 // Create a unique and deterministic fingerprint for this state.
+//
+// Deprecated: the registry no longer uses fingerprints, and hashes states
+// directly instead. Compare states with their transitions.
 func (s state) Fingerprint() string {
 	hash := sha1.New()
 	for _, transition := range s {
@@ -0,0 +1,145 @@
+package mealy
+
+import (
+	"io/ioutil"
+	"sort"
+)
+
+// Statistics describing a compiled machine. Field names are chosen to read
+// well as JSON.
+type Stats struct {
+	// Number of states.
+	States int `json:"states"`
+	// Number of transitions, summed over all states.
+	TotalTransitions int `json:"total_transitions"`
+	// Number of distinct transition values (trigger, target and terminal flag).
+	UniqueTransitions int `json:"unique_transitions"`
+	// Largest number of transitions leaving a single state.
+	MaxFanout int `json:"max_fanout"`
+	// Sorted byte values that trigger a transition anywhere.
+	Triggers []int `json:"triggers"`
+	// FanoutHistogram[n] is the number of states with exactly n transitions.
+	FanoutHistogram []int `json:"fanout_histogram"`
+	// DepthHistogram[d] is the number of states whose shortest distance from
+	// the start state is d.
+	DepthHistogram []int `json:"depth_histogram"`
+	// Number of recognized sequences.
+	Words int64 `json:"words"`
+	// The first of the longest recognized sequences, in order.
+	LongestWord string `json:"longest_word"`
+	// Size of the recognized sequences written one per line, as a word list
+	// given to mealycompile would be.
+	InputBytes int64 `json:"input_bytes"`
+	// Estimated size of the machine in memory.
+	MemoryBytes int64 `json:"memory_bytes"`
+	// Size of the machine serialized in each format, keyed by format name.
+	SerializedBytes map[string]int64 `json:"serialized_bytes"`
+	// InputBytes divided by the smallest serialized size.
+	CompressionRatio float64 `json:"compression_ratio"`
+}
+
+// Compute statistics for the machine. This visits every state a few times and
+// serializes the machine in each format, so it takes time proportional to the
+// size of the machine, but not to the number of recognized sequences.
+func (self Recognizer) Stats() Stats {
+	stats := Stats{
+		States:            len(self),
+		TotalTransitions:  self.TotalTransitions(),
+		UniqueTransitions: self.UniqueTransitions(),
+		MaxFanout:         self.MaxStateTransitions(),
+		Triggers:          []int{},
+		FanoutHistogram:   make([]int, self.MaxStateTransitions()+1),
+		DepthHistogram:    []int{},
+		SerializedBytes:   make(map[string]int64, len(formatNames)),
+	}
+	for _, t := range self.AllTriggers() {
+		stats.Triggers = append(stats.Triggers, int(t))
+	}
+	for _, s := range self {
+		stats.FanoutHistogram[len(s)]++
+	}
+	// A slice header per state, plus the transitions themselves.
+	stats.MemoryBytes = 24 + 24*int64(len(self)) + 4*int64(stats.TotalTransitions)
+
+	for f := range formatNames {
+		c := &countingWriter{w: ioutil.Discard}
+		if err := self.WriteFormat(c, f); err == nil {
+			stats.SerializedBytes[f.String()] = c.n
+		}
+	}
+	if len(self) == 0 {
+		return stats
+	}
+
+	depth := make([]int, len(self))
+	for i := range depth {
+		depth[i] = -1
+	}
+	depth[self.StartId()] = 0
+	for queue := []int{self.StartId()}; len(queue) > 0; queue = queue[1:] {
+		id := queue[0]
+		if depth[id] == len(stats.DepthHistogram) {
+			stats.DepthHistogram = append(stats.DepthHistogram, 0)
+		}
+		stats.DepthHistogram[depth[id]]++
+		for _, t := range self[id] {
+			if depth[t.ToState()] < 0 {
+				depth[t.ToState()] = depth[id] + 1
+				queue = append(queue, t.ToState())
+			}
+		}
+	}
+
+	// For each state, count the sequences recognized from it, their total
+	// length, and the length of the longest one.
+	words := make([]int64, len(self))
+	lengths := make([]int64, len(self))
+	longest := make([]int, len(self))
+	done := make([]bool, len(self))
+	var visit func(id int)
+	visit = func(id int) {
+		done[id] = true
+		for _, t := range self[id] {
+			to := t.ToState()
+			if !done[to] {
+				visit(to)
+			}
+			n := words[to]
+			if t.IsTerminal() {
+				n++
+			}
+			words[id] += n
+			lengths[id] += n + lengths[to]
+			if n > 0 && longest[to]+1 > longest[id] {
+				longest[id] = longest[to] + 1
+			}
+		}
+	}
+	visit(self.StartId())
+	start := self.StartId()
+	stats.Words = words[start]
+	stats.InputBytes = lengths[start] + words[start]
+
+	// Follow the first transition that leads to a longest sequence.
+	word := []byte{}
+	for id := start; len(word) < longest[start]; {
+		for _, t := range self[id] {
+			if longest[t.ToState()]+1 == longest[id] && (t.IsTerminal() || words[t.ToState()] > 0) {
+				word = append(word, t.Trigger())
+				id = t.ToState()
+				break
+			}
+		}
+	}
+	stats.LongestWord = string(word)
+
+	sizes := make([]int64, 0, len(stats.SerializedBytes))
+	for _, n := range stats.SerializedBytes {
+		sizes = append(sizes, n)
+	}
+	sort.Slice(sizes, func(i, j int) bool { return sizes[i] < sizes[j] })
+	if len(sizes) > 0 && sizes[0] > 0 {
+		stats.CompressionRatio = float64(stats.InputBytes) / float64(sizes[0])
+	}
+	return stats
+}
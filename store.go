@@ -0,0 +1,541 @@
+package mealy
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+// The name of the manifest file in a Store directory.
+const storeManifest = "MANIFEST.json"
+
+// Options for opening a Store.
+type StoreOptions struct {
+	// Format in which new segments are written. The zero value, FormatPlain,
+	// means FormatVarint instead, since the plain format cannot hold a state
+	// with transitions for all 256 byte values, which a store of binary keys
+	// soon has.
+	Format Format
+	// Once a write leaves at least this many segments, start compacting them
+	// in the background. Zero means segments are only compacted by calling
+	// Compact.
+	CompactAt int
+}
+
+// One generation of a Store: the sequences inserted and deleted by one batch,
+// or the result of compacting older generations. Either file may be empty.
+type manifestSegment struct {
+	Id         int    `json:"id"`
+	Keys       string `json:"keys,omitempty"`
+	Tombstones string `json:"tombstones,omitempty"`
+}
+
+// The contents of the manifest, which lists the live segments, oldest first.
+type storeManifestData struct {
+	NextId   int               `json:"next_id"`
+	Segments []manifestSegment `json:"segments"`
+}
+
+// A loaded segment.
+type storeSegment struct {
+	manifestSegment
+	keys       Recognizer
+	tombstones Recognizer
+}
+
+// A persistent, updatable set of sequences, kept in a directory as a stack of
+// immutable machines.
+//
+// Each batch of writes becomes a new segment holding a machine of inserted
+// sequences and a machine of deleted ones ("tombstones"). A sequence is in the
+// Store if the newest segment that mentions it inserted it. Reads merge all
+// segments, and Compact merges segments into one by streaming the union of
+// their sequences through a Builder, dropping the tombstones.
+//
+// The manifest naming the live segments is only ever replaced by renaming a
+// complete new one over it, after the segments it names have been written and
+// synced, so a crash at any point leaves the Store as it was before or after
+// the write. Segment and temporary files not named in the manifest are
+// removed when the Store is opened; other files in the directory are ignored.
+//
+// A Store is safe for concurrent use, and reads are not blocked by writes or
+// compaction.
+type Store struct {
+	dir  string
+	opts StoreOptions
+
+	// Held briefly to read or replace the segments.
+	mu       sync.RWMutex
+	nextId   int
+	segments []*storeSegment
+
+	// Held while changing the manifest or removing files, so that writers
+	// see each other's segments and files in progress are not removed.
+	writeMu sync.Mutex
+	// Held while compacting, so that only one compaction runs at a time.
+	compactMu sync.Mutex
+	// Tracks background compactions, so that Close can wait for them.
+	background sync.WaitGroup
+	// Whether a background compaction has been started and not finished, and
+	// the first error from one. Protected by mu.
+	compacting bool
+	err        error
+}
+
+// Open the Store in dir, creating it if it does not exist.
+func OpenStore(dir string, opts StoreOptions) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if opts.Format == FormatPlain {
+		opts.Format = FormatVarint
+	}
+	s := &Store{dir: dir, opts: opts, nextId: 1}
+
+	data, err := os.ReadFile(filepath.Join(dir, storeManifest))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		var manifest storeManifestData
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return nil, fmt.Errorf("invalid manifest in %s: %v", dir, err)
+		}
+		s.nextId = manifest.NextId
+		for _, ms := range manifest.Segments {
+			seg := &storeSegment{manifestSegment: ms}
+			if seg.keys, err = s.readSegment(ms.Keys); err != nil {
+				return nil, err
+			}
+			if seg.tombstones, err = s.readSegment(ms.Tombstones); err != nil {
+				return nil, err
+			}
+			s.segments = append(s.segments, seg)
+		}
+	}
+	if err := s.removeUnused(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Read a segment file, or return nil if name is empty.
+func (s *Store) readSegment(name string) (Recognizer, error) {
+	if name == "" {
+		return nil, nil
+	}
+	file, err := os.Open(filepath.Join(s.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	m, err := ReadFrom(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading segment %s: %v", name, err)
+	}
+	return m, nil
+}
+
+// Remove files left behind by interrupted writes and finished compactions.
+// Must be called with writeMu held, or before the Store is shared.
+func (s *Store) removeUnused() error {
+	used := map[string]bool{storeManifest: true}
+	for _, seg := range s.snapshot() {
+		used[seg.Keys] = true
+		used[seg.Tombstones] = true
+	}
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if used[name] || e.IsDir() {
+			continue
+		}
+		if isStoreFile(name) {
+			if err := os.Remove(filepath.Join(s.dir, name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Matches the names of segment files, and of the temporary files they and the
+// manifest are written to before being renamed into place.
+var storeFilePattern = regexp.MustCompile(
+	`^(\d{8}\.(keys|tombstones)\.mealy|` + regexp.QuoteMeta(storeManifest) + `)(\.tmp\d+)?$`)
+
+// Return true if name is one of the files a Store creates, other than the
+// manifest itself. Only these are ever removed, so that unrelated files in
+// the same directory are left alone.
+func isStoreFile(name string) bool {
+	return name != storeManifest && storeFilePattern.MatchString(name)
+}
+
+// Write a file by writing a temporary file in the same directory, syncing it,
+// and renaming it into place, then syncing the directory.
+func writeFileAtomic(dir, name string, write func(w io.Writer) error) error {
+	tmp, err := os.CreateTemp(dir, name+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err = write(tmp); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), filepath.Join(dir, name)); err != nil {
+		return err
+	}
+	// Not all platforms can sync a directory, so errors are ignored.
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// Write m as a segment file, unless it recognizes nothing. Returns the name of
+// the file, or "" if none was written.
+func (s *Store) writeSegment(name string, m Recognizer) (string, error) {
+	if len(m) <= 1 {
+		return "", nil
+	}
+	return name, writeFileAtomic(s.dir, name, func(w io.Writer) error {
+		return m.WriteFormat(w, s.opts.Format)
+	})
+}
+
+// Write the manifest for the given segments, and make them current. Must be
+// called with writeMu held.
+func (s *Store) setSegments(segments []*storeSegment) error {
+	s.mu.RLock()
+	manifest := storeManifestData{NextId: s.nextId, Segments: []manifestSegment{}}
+	s.mu.RUnlock()
+	for _, seg := range segments {
+		manifest.Segments = append(manifest.Segments, seg.manifestSegment)
+	}
+	err := writeFileAtomic(s.dir, storeManifest, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(manifest)
+	})
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.segments = segments
+	s.mu.Unlock()
+	return nil
+}
+
+// Reserve an ID for a new segment.
+func (s *Store) newId() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextId++
+	return s.nextId - 1
+}
+
+// Build a segment from sorted keys and tombstones, and write its files.
+func (s *Store) newSegment(id int, keys, tombstones Recognizer) (*storeSegment, error) {
+	seg := &storeSegment{keys: keys, tombstones: tombstones}
+	seg.Id = id
+	var err error
+	if seg.Keys, err = s.writeSegment(fmt.Sprintf("%08d.keys.mealy", id), keys); err != nil {
+		return nil, err
+	}
+	if seg.Tombstones, err = s.writeSegment(fmt.Sprintf("%08d.tombstones.mealy", id), tombstones); err != nil {
+		return nil, err
+	}
+	if seg.Keys == "" {
+		seg.keys = nil
+	}
+	if seg.Tombstones == "" {
+		seg.tombstones = nil
+	}
+	return seg, nil
+}
+
+// A set of changes to apply to a Store at once. When a sequence is both
+// inserted and deleted, the last change wins.
+type Batch struct {
+	changes map[string]bool
+}
+
+// Record that key should be inserted. Empty keys are ignored.
+func (b *Batch) Insert(key []byte) {
+	b.set(key, true)
+}
+
+// Record that key should be deleted. Empty keys are ignored.
+func (b *Batch) Delete(key []byte) {
+	b.set(key, false)
+}
+
+func (b *Batch) set(key []byte, insert bool) {
+	if len(key) == 0 {
+		return
+	}
+	if b.changes == nil {
+		b.changes = make(map[string]bool)
+	}
+	b.changes[string(key)] = insert
+}
+
+// Return the number of distinct keys changed by the batch.
+func (b *Batch) Len() int {
+	return len(b.changes)
+}
+
+// Apply the changes in b as a new segment. Nothing is written for an empty
+// batch.
+func (s *Store) Write(b *Batch) error {
+	if b.Len() == 0 {
+		return nil
+	}
+	inserted, deleted := [][]byte{}, [][]byte{}
+	for k, insert := range b.changes {
+		if insert {
+			inserted = append(inserted, []byte(k))
+		} else {
+			deleted = append(deleted, []byte(k))
+		}
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	seg, err := s.newSegment(s.newId(), fromSlice(inserted), fromSlice(deleted))
+	if err != nil {
+		return err
+	}
+	current := s.snapshot()
+	if err := s.setSegments(append(current[:len(current):len(current)], seg)); err != nil {
+		return err
+	}
+
+	if s.opts.CompactAt > 0 && len(current)+1 >= s.opts.CompactAt {
+		s.compactInBackground()
+	}
+	return nil
+}
+
+// Start compacting in a new goroutine, unless a background compaction is
+// already under way.
+func (s *Store) compactInBackground() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.compacting {
+		return
+	}
+	s.compacting = true
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		err := s.Compact()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.compacting = false
+		if s.err == nil {
+			s.err = err
+		}
+	}()
+}
+
+// Return the current segments, oldest first. They are never modified, so they
+// can be read without holding the lock.
+func (s *Store) snapshot() []*storeSegment {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.segments
+}
+
+// Return the number of live segments.
+func (s *Store) Segments() int {
+	return len(s.snapshot())
+}
+
+// Return true if key is in the Store.
+func (s *Store) Recognizes(key []byte) bool {
+	segments := s.snapshot()
+	for i := len(segments) - 1; i >= 0; i-- {
+		if segments[i].tombstones.Recognizes(key) {
+			return false
+		}
+		if segments[i].keys.Recognizes(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// One stream of sorted sequences being merged, from a segment of the given
+// age. Newer segments have greater ages.
+type layerSource struct {
+	values    <-chan []byte
+	value     []byte
+	age       int
+	tombstone bool
+}
+
+// Implements heap.Interface, ordering sources by their current values, and
+// newest first among equal values.
+type layerHeap []*layerSource
+
+func (h layerHeap) Len() int {
+	return len(h)
+}
+func (h layerHeap) Less(i, j int) bool {
+	if c := bytes.Compare(h[i].value, h[j].value); c != 0 {
+		return c < 0
+	}
+	return h[i].age > h[j].age
+}
+func (h layerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+func (h *layerHeap) Push(x interface{}) {
+	*h = append(*h, x.(*layerSource))
+}
+func (h *layerHeap) Pop() interface{} {
+	x := (*h)[len(*h)-1]
+	*h = (*h)[:len(*h)-1]
+	return x
+}
+
+// Merge the prefixed sequences of the given segments, oldest first, into one
+// sorted stream, in which each sequence appears if the newest segment
+// mentioning it inserted it.
+//
+// This is a streaming union: only the current value of each segment is held
+// at any time.
+func mergeSegments(segments []*storeSegment, prefix []byte) <-chan []byte {
+	h := layerHeap{}
+	push := func(src *layerSource) {
+		if v, ok := <-src.values; ok {
+			src.value = v
+			heap.Push(&h, src)
+		}
+	}
+	for age, seg := range segments {
+		if seg.keys != nil {
+			push(&layerSource{values: seg.keys.PrefixSequences(prefix), age: age})
+		}
+		if seg.tombstones != nil {
+			push(&layerSource{values: seg.tombstones.PrefixSequences(prefix), age: age, tombstone: true})
+		}
+	}
+
+	out := make(chan []byte)
+	go func() {
+		defer close(out)
+		for h.Len() > 0 {
+			newest := heap.Pop(&h).(*layerSource)
+			value := newest.value
+			for h.Len() > 0 && bytes.Equal(h[0].value, value) {
+				push(heap.Pop(&h).(*layerSource))
+			}
+			if !newest.tombstone {
+				out <- value
+			}
+			push(newest)
+		}
+	}()
+	return out
+}
+
+// Return a channel of all sequences in the Store, in order.
+func (s *Store) AllSequences() <-chan []byte {
+	return s.PrefixSequences(nil)
+}
+
+// Return a channel of all sequences in the Store that begin with prefix, in
+// order. The channel reflects the Store as it was when this was called.
+func (s *Store) PrefixSequences(prefix []byte) <-chan []byte {
+	return mergeSegments(s.snapshot(), prefix)
+}
+
+// Merge all current segments into one. Writes made while compacting are kept
+// in newer segments. Compaction can run concurrently with reads and writes, so
+// calling this in its own goroutine compacts in the background.
+func (s *Store) Compact() error {
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+
+	old := s.snapshot()
+	if len(old) < 2 && (len(old) == 0 || old[0].tombstones == nil) {
+		return nil
+	}
+	// Since these are the oldest segments, tombstones have nothing left to
+	// hide and can be dropped.
+	b := NewBuilder(BuildOptions{})
+	var err error
+	for v := range mergeSegments(old, nil) {
+		// Keep draining after an error so the merge can finish.
+		if err == nil {
+			err = b.Add(v)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	keys, err := b.Finish()
+	if err != nil {
+		return err
+	}
+	merged, err := s.newSegment(s.newId(), keys, nil)
+	if err != nil {
+		return err
+	}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	// Writes only ever append, so the segments compacted are still first.
+	segments := append([]*storeSegment{merged}, s.snapshot()[len(old):]...)
+	if merged.keys == nil {
+		segments = segments[1:]
+	}
+	if err := s.setSegments(segments); err != nil {
+		return err
+	}
+	return s.removeUnused()
+}
+
+// Wait for background compaction to finish, returning the first error it
+// encountered, if any.
+func (s *Store) Close() error {
+	s.background.Wait()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.err
+}
+
+// Return the names of the files in use, sorted. Useful for backups, which must
+// copy these along with the manifest.
+func (s *Store) Files() []string {
+	names := []string{storeManifest}
+	for _, seg := range s.snapshot() {
+		for _, name := range []string{seg.Keys, seg.Tombstones} {
+			if name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,200 @@
+package mealy
+
+import (
+	"bytes"
+	"sort"
+)
+
+// Return a copy of value with its bytes in reverse order.
+func reversedBytes(value []byte) []byte {
+	r := make([]byte, len(value))
+	for i, b := range value {
+		r[len(value)-1-i] = b
+	}
+	return r
+}
+
+// Build a machine from values in any order. Sorts values in place and skips
+// duplicates.
+func fromSlice(values [][]byte) Recognizer {
+	sort.Slice(values, func(i, j int) bool {
+		return bytes.Compare(values[i], values[j]) < 0
+	})
+	ch := make(chan []byte)
+	go func() {
+		defer close(ch)
+		var prev []byte
+		for i, v := range values {
+			if i > 0 && bytes.Equal(prev, v) {
+				continue
+			}
+			ch <- v
+			prev = v
+		}
+	}()
+	return FromChannel(ch)
+}
+
+// Return a machine that recognizes the reverse of every sequence recognized by
+// this one. Walking the reversed machine answers questions about how sequences
+// end, just as walking the original answers questions about how they begin.
+//
+// The reversed sequences are sorted with the default SortOptions; see
+// ReversedWith.
+func (self Recognizer) Reversed() (Recognizer, error) {
+	return self.ReversedWith(SortOptions{})
+}
+
+// Return a machine that recognizes the reverse of every sequence recognized by
+// this one. The reversed sequences are streamed through a Sorter with the
+// given options, so only the memory budget (not every sequence) is held in
+// memory at once, and the rest are sorted in runs on disk.
+func (self Recognizer) ReversedWith(opts SortOptions) (Recognizer, error) {
+	reversed := make(chan []byte)
+	go func() {
+		defer close(reversed)
+		for v := range self.AllSequences() {
+			reversed <- reversedBytes(v)
+		}
+	}()
+	return FromUnsorted(reversed, opts)
+}
+
+// Holds a machine together with its reverse, so that queries on both
+// prefixes and suffixes can be answered without enumerating everything.
+type SuffixIndex struct {
+	Forward  Recognizer
+	Reversed Recognizer
+}
+
+// Create a suffix index by building the reverse of the given machine.
+func NewSuffixIndex(forward Recognizer) (SuffixIndex, error) {
+	reversed, err := forward.Reversed()
+	if err != nil {
+		return SuffixIndex{}, err
+	}
+	return SuffixIndex{forward, reversed}, nil
+}
+
+func (x SuffixIndex) Recognizes(value []byte) bool {
+	return x.Forward.Recognizes(value)
+}
+
+// Return true if any recognized sequence ends with suffix.
+func (x SuffixIndex) HasSuffix(suffix []byte) bool {
+	return hasPrefix(x.Reversed, reversedBytes(suffix))
+}
+
+// Return a channel of all recognized sequences that end with suffix. Note that
+// they are ordered by their reversed values, so sequences that share longer
+// endings are emitted together.
+func (x SuffixIndex) SuffixSequences(suffix []byte) <-chan []byte {
+	out := make(chan []byte)
+	go func() {
+		defer close(out)
+		for v := range x.Reversed.PrefixSequences(reversedBytes(suffix)) {
+			out <- reversedBytes(v)
+		}
+	}()
+	return out
+}
+
+// Return true if any recognized sequence begins with prefix. Every transition
+// in a machine built by this package leads to at least one recognized
+// sequence, so this only needs to walk the prefix.
+func hasPrefix(m Recognizer, prefix []byte) bool {
+	id := m.StartId()
+	if len(prefix) == 0 {
+		return id >= 0 && !m[id].IsEmpty()
+	}
+	for _, b := range prefix {
+		var ok bool
+		if id, _, ok = m.Step(id, b); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Extends a SuffixIndex with a machine recognizing every non-empty suffix of
+// every recognized sequence (a DAWG of suffixes). Since every substring is a
+// prefix of some suffix, this answers "contains" queries.
+type SubstringIndex struct {
+	SuffixIndex
+	Suffixes Recognizer
+}
+
+// Create a substring index by building the reverse and suffix machines for
+// the given one.
+func NewSubstringIndex(forward Recognizer) (SubstringIndex, error) {
+	x, err := NewSuffixIndex(forward)
+	if err != nil {
+		return SubstringIndex{}, err
+	}
+	suffixes, err := forward.AllSuffixes()
+	if err != nil {
+		return SubstringIndex{}, err
+	}
+	return SubstringIndex{x, suffixes}, nil
+}
+
+// Return a machine that recognizes every non-empty suffix of every sequence
+// recognized by this one. The suffixes are sorted with the default
+// SortOptions; see AllSuffixesWith.
+func (self Recognizer) AllSuffixes() (Recognizer, error) {
+	return self.AllSuffixesWith(SortOptions{})
+}
+
+// Return a machine that recognizes every non-empty suffix of every sequence
+// recognized by this one. The suffixes are streamed through a Sorter with the
+// given options, so only the memory budget (not every suffix) is held in
+// memory at once, and the rest are sorted in runs on disk.
+func (self Recognizer) AllSuffixesWith(opts SortOptions) (Recognizer, error) {
+	suffixes := make(chan []byte)
+	go func() {
+		defer close(suffixes)
+		for v := range self.AllSequences() {
+			for i := range v {
+				suffixes <- v[i:]
+			}
+		}
+	}()
+	return FromUnsorted(suffixes, opts)
+}
+
+// Return true if any recognized sequence contains sub.
+func (x SubstringIndex) Contains(sub []byte) bool {
+	return hasPrefix(x.Suffixes, sub)
+}
+
+// Return a channel of all recognized sequences that contain sub, in order.
+//
+// Each suffix starting with sub is looked up in the reversed machine to find
+// the sequences ending with it. The work done is thus proportional to the
+// number of distinct suffixes beginning with sub, plus the number of times the
+// matching sequences are found through them (a sequence containing sub more
+// than once is found once per occurrence), rather than to the size of the
+// machine. All matches are collected in memory so they can be sent in order.
+func (x SubstringIndex) SubstringSequences(sub []byte) <-chan []byte {
+	out := make(chan []byte)
+	go func() {
+		defer close(out)
+		seen := make(map[string]bool)
+		values := [][]byte{}
+		for suffix := range x.Suffixes.PrefixSequences(sub) {
+			for v := range x.SuffixSequences(suffix) {
+				if !seen[string(v)] {
+					seen[string(v)] = true
+					values = append(values, v)
+				}
+			}
+		}
+		sort.Slice(values, func(i, j int) bool {
+			return bytes.Compare(values[i], values[j]) < 0
+		})
+		for _, v := range values {
+			out <- v
+		}
+	}()
+	return out
+}
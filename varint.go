@@ -0,0 +1,99 @@
+package mealy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Must always be 6 bytes.
+const varintPrefix = "MMeMv3"
+
+// Write a machine using variable-length integers. The state count and each
+// state's fanout are uvarints. Each transition is a uvarint giving the
+// difference between its trigger and the previous trigger in the same state
+// (or zero), followed by a signed varint whose low bit is the terminal flag
+// and whose remaining bits give the target state's ID relative to the current
+// state's. Since states are created close to the states they lead to, most
+// transitions fit in two or three bytes.
+func (self Recognizer) writeVarint(w io.Writer) (err error) {
+	bw := bufio.NewWriter(w)
+	buf := make([]byte, binary.MaxVarintLen64)
+	putUvarint := func(v uint64) error {
+		_, err := bw.Write(buf[:binary.PutUvarint(buf, v)])
+		return err
+	}
+	putVarint := func(v int64) error {
+		_, err := bw.Write(buf[:binary.PutVarint(buf, v)])
+		return err
+	}
+
+	if err = putUvarint(uint64(len(self))); err != nil {
+		return
+	}
+	for id, s := range self {
+		if err = putUvarint(uint64(len(s))); err != nil {
+			return
+		}
+		prev := byte(0)
+		for _, t := range s {
+			if err = putUvarint(uint64(t.Trigger() - prev)); err != nil {
+				return
+			}
+			prev = t.Trigger()
+			target := int64(t.ToState()-id) << 1
+			if t.IsTerminal() {
+				target |= 1
+			}
+			if err = putVarint(target); err != nil {
+				return
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+func readVarint(r io.Reader) (f FlatRecognizer, err error) {
+	br := byteReader(r)
+	numStates, err := binary.ReadUvarint(br)
+	if err != nil {
+		return
+	}
+	if numStates > maxStates {
+		err = fmt.Errorf("state count %d exceeds the maximum of %d", numStates, maxStates)
+		return
+	}
+	f.offsets = make([]uint32, 1, numStates+1)
+	for id := 0; id < int(numStates); id++ {
+		var fanout uint64
+		if fanout, err = binary.ReadUvarint(br); err != nil {
+			return
+		}
+		if fanout > 256 {
+			err = fmt.Errorf("state %d has impossible fanout %d", id, fanout)
+			return
+		}
+		prev := uint64(0)
+		for j := 0; j < int(fanout); j++ {
+			var delta uint64
+			var target int64
+			if delta, err = binary.ReadUvarint(br); err != nil {
+				return
+			}
+			if target, err = binary.ReadVarint(br); err != nil {
+				return
+			}
+			prev += delta
+			toState := int64(id) + target>>1
+			if prev > 0xff || toState < 0 || toState >= int64(numStates) {
+				err = fmt.Errorf("state %d has an invalid transition", id)
+				return
+			}
+			f.transitions = append(f.transitions,
+				NewTransition(byte(prev), int(toState), target&1 == 1))
+		}
+		f.offsets = append(f.offsets, uint32(len(f.transitions)))
+	}
+	return
+}